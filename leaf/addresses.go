@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+type pinnedAddressKey struct{}
+
+// withPinnedAddress makes connections dialled with the context go to the given IP address
+// instead of whatever the hostname resolves to, leaving SNI and the Host header unchanged.
+func withPinnedAddress(ctx context.Context, ip string) context.Context {
+	if ip == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, pinnedAddressKey{}, ip)
+}
+
+// pinAddress replaces the host of a host:port address with the IP address pinned in the
+// context, if any.
+func pinAddress(ctx context.Context, address string) string {
+	ip, ok := ctx.Value(pinnedAddressKey{}).(string)
+	if !ok {
+		return address
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return net.JoinHostPort(ip, port)
+}
+
+// probeHost returns the host to connect to for a probe, which is the target address if
+// each address of the origin is probed separately.
+func probeHost(origin types.OriginEntry, labels probeLabels) string {
+	if labels.TargetIP != "" {
+		return labels.TargetIP
+	}
+
+	return origin.Hostname
+}
+
+// resolveProbeTargets resolves every address of the given family which a hostname resolves
+// to, in a stable order.
+func resolveProbeTargets(ctx context.Context, hostname, family string) ([]string, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	targets := []string{}
+	for _, addr := range addrs {
+		if family == types.IPFamilyIPv4 || family == types.IPFamilyIPv6 {
+			if ipFamily(addr.IP) != family {
+				continue
+			}
+		}
+		targets = append(targets, addr.IP.String())
+	}
+	if len(targets) == 0 {
+		return nil, terrors.NotFound("address", fmt.Sprintf("No %s addresses found for %s", family, hostname), nil)
+	}
+	sort.Strings(targets)
+
+	return targets, nil
+}
+
+// addressTracker remembers the addresses each origin last resolved to, so that addresses
+// appearing and disappearing can be reported.
+type addressTracker struct {
+	mu        sync.Mutex
+	addresses map[string]map[string]bool
+}
+
+var originAddresses = &addressTracker{
+	addresses: map[string]map[string]bool{},
+}
+
+// update records the latest addresses of an origin, returning those which were added and
+// removed since the last update. Nothing is reported the first time an origin resolves.
+func (t *addressTracker) update(labels probeLabels, targets []string) ([]string, []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := strings.Join(labels.values(), "/")
+	current := map[string]bool{}
+	for _, target := range targets {
+		current[target] = true
+	}
+
+	previous, found := t.addresses[key]
+	t.addresses[key] = current
+	if !found {
+		return nil, nil
+	}
+
+	added, removed := []string{}, []string{}
+	for target := range current {
+		if !previous[target] {
+			added = append(added, target)
+		}
+	}
+	for target := range previous {
+		if !current[target] {
+			removed = append(removed, target)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	return added, removed
+}
+
+// forget drops the addresses an origin last resolved to.
+func (t *addressTracker) forget(labels probeLabels) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.addresses, strings.Join(labels.values(), "/"))
+}
+
+// probeAllAddresses resolves the hostname of an origin and probes each of its addresses
+// concurrently, labelling each probe with its target address.
+func probeAllAddresses(ctx context.Context, p prober, origin types.OriginEntry, labels probeLabels) {
+	targets, err := resolveProbeTargets(ctx, origin.Hostname, labels.IPFamily)
+	if err != nil {
+		registerProbeResult(labels, false, classifyError(err))
+		slog.Error(ctx, "Error resolving addresses of %s: %v", origin.URL, err)
+		return
+	}
+
+	added, removed := originAddresses.update(labels, targets)
+	if len(added) > 0 || len(removed) > 0 {
+		slog.Warn(ctx, "Addresses of %s changed, added %v and removed %v", origin.URL, added, removed)
+	}
+	for _, target := range removed {
+		targetLabels := labels
+		targetLabels.TargetIP = target
+		forgetSeries(targetLabels)
+		deleteProbeMetrics(targetLabels)
+	}
+	registerOriginAddresses(labels, len(targets), len(added), len(removed))
+
+	wg := sync.WaitGroup{}
+	for _, target := range targets {
+		targetLabels := labels
+		targetLabels.TargetIP = target
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			probeOnce(ctx, p, origin, targetLabels)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// readResponseBody reads the body of a probe response. If maxBytes is set, at most one byte
+// more than that is read, which is enough to tell that the body was too large.
+func readResponseBody(r typhon.Response, maxBytes int64) ([]byte, bool, error) {
+	defer r.Body.Close()
+
+	var reader io.Reader = r.Body
+	if maxBytes > 0 {
+		reader = io.LimitReader(r.Body, maxBytes+1)
+	}
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return body, maxBytes > 0 && int64(len(body)) > maxBytes, nil
+}
+
+// checkAssertions checks a response against the assertions of its origin, returning the
+// reason for the first assertion failed.
+func checkAssertions(assertions types.OriginAssertions, statusCode int, body []byte) (bool, string) {
+	if !statusAccepted(assertions.StatusCodes, statusCode) {
+		return false, statusReason(statusCode)
+	}
+
+	if assertions.BodyContains != "" && !bytes.Contains(body, []byte(assertions.BodyContains)) {
+		return false, reasonBodyMismatch
+	}
+	if assertions.BodyNotContains != "" && bytes.Contains(body, []byte(assertions.BodyNotContains)) {
+		return false, reasonBodyMismatch
+	}
+	if assertions.BodyPattern != nil && !assertions.BodyPattern.Match(body) {
+		return false, reasonBodyMismatch
+	}
+	if assertions.BodyNotPattern != nil && assertions.BodyNotPattern.Match(body) {
+		return false, reasonBodyMismatch
+	}
+
+	if len(assertions.JSONFields) == 0 {
+		return true, ""
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return false, reasonJSONMismatch
+	}
+
+	for path, expected := range assertions.JSONFields {
+		value, found := lookupJSONPath(document, path)
+		if !found || !reflect.DeepEqual(value, expected) {
+			return false, reasonJSONMismatch
+		}
+	}
+
+	return true, ""
+}
+
+func statusAccepted(accepted []int, statusCode int) bool {
+	if len(accepted) == 0 {
+		return statusCode < 400
+	}
+
+	for _, code := range accepted {
+		if code == statusCode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupJSONPath finds the value at a dot-separated path in a decoded JSON document, where
+// numeric path segments index into arrays.
+func lookupJSONPath(document interface{}, path string) (interface{}, bool) {
+	current := document
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, found := node[segment]
+			if !found {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return current, true
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+func TestCheckAssertions(t *testing.T) {
+	healthy := []byte(`{"status": "ok", "checks": {"database": [{"healthy": true}, {"healthy": false, "lag": 2}]}}`)
+
+	cases := []struct {
+		name       string
+		assertions types.OriginAssertions
+		statusCode int
+		body       []byte
+		reason     string // Empty if the response passes
+	}{
+		{"any status below 400 by default", types.OriginAssertions{}, 302, nil, ""},
+		{"4xx status by default", types.OriginAssertions{}, 404, nil, reasonHTTPStatus4xx},
+		{"5xx status by default", types.OriginAssertions{}, 503, nil, reasonHTTPStatus5xx},
+		{"status listed", types.OriginAssertions{StatusCodes: []int{200, 404}}, 404, nil, ""},
+		{"status not listed below 400", types.OriginAssertions{StatusCodes: []int{200}}, 301, nil, reasonHTTPStatus},
+		{"status not listed above 400", types.OriginAssertions{StatusCodes: []int{200, 404}}, 500, nil, reasonHTTPStatus5xx},
+		{"body contains", types.OriginAssertions{BodyContains: `"ok"`}, 200, healthy, ""},
+		{"body does not contain", types.OriginAssertions{BodyContains: "degraded"}, 200, healthy, reasonBodyMismatch},
+		{"body contains what it must not", types.OriginAssertions{BodyNotContains: `"healthy": false`}, 200, healthy, reasonBodyMismatch},
+		{"body matches", types.OriginAssertions{BodyPattern: regexp.MustCompile(`"lag": \d+`)}, 200, healthy, ""},
+		{"body does not match", types.OriginAssertions{BodyPattern: regexp.MustCompile(`^ok$`)}, 200, healthy, reasonBodyMismatch},
+		{"body matches what it must not", types.OriginAssertions{BodyNotPattern: regexp.MustCompile(`"lag": [1-9]`)}, 200, healthy, reasonBodyMismatch},
+		{"status checked before body", types.OriginAssertions{BodyContains: "degraded"}, 500, healthy, reasonHTTPStatus5xx},
+		{
+			"json fields",
+			types.OriginAssertions{JSONFields: map[string]interface{}{"status": "ok", "checks.database.0.healthy": true, "checks.database.1.lag": float64(2)}},
+			200, healthy, "",
+		},
+		{"json field differs", types.OriginAssertions{JSONFields: map[string]interface{}{"checks.database.1.healthy": true}}, 200, healthy, reasonJSONMismatch},
+		{"json field missing", types.OriginAssertions{JSONFields: map[string]interface{}{"checks.cache.healthy": true}}, 200, healthy, reasonJSONMismatch},
+		{"json index out of range", types.OriginAssertions{JSONFields: map[string]interface{}{"checks.database.2.healthy": true}}, 200, healthy, reasonJSONMismatch},
+		{"json body invalid", types.OriginAssertions{JSONFields: map[string]interface{}{"status": "ok"}}, 200, []byte("ok"), reasonJSONMismatch},
+	}
+
+	for _, c := range cases {
+		ok, reason := checkAssertions(c.assertions, c.statusCode, c.body)
+		if ok != (c.reason == "") || reason != c.reason {
+			t.Errorf("%s: expected reason %q, got %v and %q", c.name, c.reason, ok, reason)
+		}
+	}
+}
+
+func TestLookupJSONPath(t *testing.T) {
+	document := map[string]interface{}{
+		"checks": map[string]interface{}{
+			"database": []interface{}{
+				map[string]interface{}{"healthy": true},
+			},
+		},
+		"version": "1.2",
+	}
+
+	cases := []struct {
+		path  string
+		value interface{}
+		found bool
+	}{
+		{"version", "1.2", true},
+		{"checks.database.0.healthy", true, true},
+		{"checks.database.0", map[string]interface{}{"healthy": true}, true},
+		{"checks.database.1.healthy", nil, false},
+		{"checks.database.-1", nil, false},
+		{"checks.database.first", nil, false},
+		{"checks.cache", nil, false},
+		{"version.major", nil, false},
+		{"", nil, false},
+	}
+
+	for _, c := range cases {
+		value, found := lookupJSONPath(document, c.path)
+		if found != c.found || !reflect.DeepEqual(value, c.value) {
+			t.Errorf("%q: expected %v and %v, got %v and %v", c.path, c.value, c.found, value, found)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// burstReply is a reply received to one of a burst of sequence-numbered packets.
+type burstReply struct {
+	Seq      uint32
+	Received time.Time
+	TTL      int // Only known for ICMP replies
+}
+
+// burstResult summarises the replies received to a single burst of packets.
+type burstResult struct {
+	Sent       int
+	Received   int // Unique replies, not counting duplicates
+	Duplicates int
+	Reordered  int
+	RTTs       []time.Duration // In the order replies arrived
+	RTTMin     time.Duration
+	RTTAvg     time.Duration
+	RTTMax     time.Duration
+	Jitter     time.Duration
+	TTL        int // Of the latest unique reply, if known
+}
+
+// summariseBurst computes statistics from replies in the order they arrived. Jitter is
+// estimated as in RFC 3550, from the differences in round trip time between consecutive
+// replies.
+func summariseBurst(sendTimes []time.Time, replies []burstReply) burstResult {
+	result := burstResult{
+		Sent: len(sendTimes),
+	}
+
+	seen := map[uint32]bool{}
+	highestSeq := -1
+	var totalRTT, previousRTT time.Duration
+	var jitter float64
+	for _, reply := range replies {
+		if seen[reply.Seq] {
+			result.Duplicates++
+			continue
+		}
+		seen[reply.Seq] = true
+
+		if int(reply.Seq) < highestSeq {
+			result.Reordered++
+		} else {
+			highestSeq = int(reply.Seq)
+		}
+
+		rtt := reply.Received.Sub(sendTimes[reply.Seq])
+		if result.Received == 0 || rtt < result.RTTMin {
+			result.RTTMin = rtt
+		}
+		if rtt > result.RTTMax {
+			result.RTTMax = rtt
+		}
+		if result.Received > 0 {
+			d := rtt - previousRTT
+			if d < 0 {
+				d = -d
+			}
+			jitter += (float64(d) - jitter) / 16
+		}
+
+		if reply.TTL > 0 {
+			result.TTL = reply.TTL
+		}
+
+		result.RTTs = append(result.RTTs, rtt)
+		totalRTT += rtt
+		previousRTT = rtt
+		result.Received++
+	}
+
+	if result.Received > 0 {
+		result.RTTAvg = totalRTT / time.Duration(result.Received)
+	}
+	result.Jitter = time.Duration(jitter)
+
+	return result
+}
+
+// sendBurst calls send with the sequence number of each packet of a burst, an interval
+// apart, until the burst is sent, send fails or the context is done.
+func sendBurst(ctx context.Context, count int, interval time.Duration, send func(seq int) error) error {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 && tick != nil {
+			select {
+			case <-ctx.Done():
+			case <-tick:
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := send(seq); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// burstDeadline returns when to stop waiting for replies to a burst, which is the given
+// wait after its last packet is sent, but no later than the deadline of the probe.
+func burstDeadline(ctx context.Context, count int, interval, wait time.Duration) time.Time {
+	deadline := time.Now().Add(time.Duration(count)*interval + wait)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+
+	return deadline
+}
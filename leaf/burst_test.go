@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSummariseBurst(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+
+	// Four packets sent 10ms apart
+	sendTimes := []time.Time{start, start.Add(ms(10)), start.Add(ms(20)), start.Add(ms(30))}
+	reply := func(seq uint32, rtt time.Duration) burstReply {
+		return burstReply{Seq: seq, Received: sendTimes[seq].Add(rtt)}
+	}
+
+	cases := []struct {
+		name     string
+		replies  []burstReply
+		expected burstResult
+	}{
+		{
+			name:     "no replies",
+			replies:  nil,
+			expected: burstResult{Sent: 4},
+		},
+		{
+			name:    "all replies in order",
+			replies: []burstReply{reply(0, ms(5)), reply(1, ms(5)), reply(2, ms(5)), reply(3, ms(5))},
+			expected: burstResult{
+				Sent: 4, Received: 4,
+				RTTs:   []time.Duration{ms(5), ms(5), ms(5), ms(5)},
+				RTTMin: ms(5), RTTAvg: ms(5), RTTMax: ms(5),
+			},
+		},
+		{
+			name:    "lost replies",
+			replies: []burstReply{reply(0, ms(5)), reply(3, ms(7))},
+			expected: burstResult{
+				Sent: 4, Received: 2,
+				RTTs:   []time.Duration{ms(5), ms(7)},
+				RTTMin: ms(5), RTTAvg: ms(6), RTTMax: ms(7),
+				Jitter: ms(2) / 16,
+			},
+		},
+		{
+			name:    "reordered replies",
+			replies: []burstReply{reply(0, ms(5)), reply(2, ms(5)), reply(1, ms(21)), reply(3, ms(5))},
+			expected: burstResult{
+				Sent: 4, Received: 4, Reordered: 1,
+				RTTs:   []time.Duration{ms(5), ms(5), ms(21), ms(5)},
+				RTTMin: ms(5), RTTAvg: ms(9), RTTMax: ms(21),
+				// 16ms then 16ms again, from the late reply and back
+				Jitter: time.Duration(float64(ms(16))/16 + (float64(ms(16))-float64(ms(16))/16)/16),
+			},
+		},
+		{
+			name:    "duplicated replies",
+			replies: []burstReply{reply(0, ms(5)), reply(0, ms(6)), reply(1, ms(5)), reply(1, ms(9)), reply(1, ms(9))},
+			expected: burstResult{
+				Sent: 4, Received: 2, Duplicates: 3,
+				RTTs:   []time.Duration{ms(5), ms(5)},
+				RTTMin: ms(5), RTTAvg: ms(5), RTTMax: ms(5),
+			},
+		},
+		{
+			name:    "late reply to the first packet",
+			replies: []burstReply{reply(1, ms(5)), reply(2, ms(5)), reply(3, ms(5)), reply(0, ms(100))},
+			expected: burstResult{
+				Sent: 4, Received: 4, Reordered: 1,
+				RTTs:   []time.Duration{ms(5), ms(5), ms(5), ms(100)},
+				RTTMin: ms(5), RTTAvg: ms(115) / 4, RTTMax: ms(100),
+				Jitter: ms(95) / 16,
+			},
+		},
+		{
+			name:    "ttl of the latest unique reply",
+			replies: []burstReply{{Seq: 0, Received: start.Add(ms(5)), TTL: 60}, {Seq: 1, Received: sendTimes[1].Add(ms(5)), TTL: 58}, {Seq: 1, Received: sendTimes[1].Add(ms(6)), TTL: 50}},
+			expected: burstResult{
+				Sent: 4, Received: 2, Duplicates: 1,
+				RTTs:   []time.Duration{ms(5), ms(5)},
+				RTTMin: ms(5), RTTAvg: ms(5), RTTMax: ms(5),
+				TTL: 58,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			result := summariseBurst(sendTimes, c.replies)
+
+			if result.Sent != c.expected.Sent || result.Received != c.expected.Received || result.Duplicates != c.expected.Duplicates || result.Reordered != c.expected.Reordered {
+				t.Errorf("expected %d sent, %d received, %d duplicates and %d reordered, got %d, %d, %d and %d",
+					c.expected.Sent, c.expected.Received, c.expected.Duplicates, c.expected.Reordered,
+					result.Sent, result.Received, result.Duplicates, result.Reordered)
+			}
+			if len(result.RTTs) != len(c.expected.RTTs) {
+				t.Fatalf("expected round trip times %v, got %v", c.expected.RTTs, result.RTTs)
+			}
+			for i := range result.RTTs {
+				if result.RTTs[i] != c.expected.RTTs[i] {
+					t.Errorf("expected round trip times %v, got %v", c.expected.RTTs, result.RTTs)
+					break
+				}
+			}
+			if result.RTTMin != c.expected.RTTMin || result.RTTAvg != c.expected.RTTAvg || result.RTTMax != c.expected.RTTMax {
+				t.Errorf("expected min, avg and max of %v, %v and %v, got %v, %v and %v",
+					c.expected.RTTMin, c.expected.RTTAvg, c.expected.RTTMax, result.RTTMin, result.RTTAvg, result.RTTMax)
+			}
+			if result.Jitter != c.expected.Jitter {
+				t.Errorf("expected jitter %v, got %v", c.expected.Jitter, result.Jitter)
+			}
+			if result.TTL != c.expected.TTL {
+				t.Errorf("expected ttl %d, got %d", c.expected.TTL, result.TTL)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Checks which found a response to be stale, recorded in the check label of stale responses
+const (
+	staleCheckNonce = "nonce"
+	staleCheckToken = "token"
+)
+
+// tokenTracker remembers the token each series of advanced probes last received, as an
+// origin never returns the same token twice, and a repeated one can only have come from a
+// cache somewhere in between.
+type tokenTracker struct {
+	mu     sync.Mutex
+	tokens map[string]originToken
+}
+
+// originToken is the token last received by a series of probes.
+type originToken struct {
+	labels probeLabels
+	token  string
+}
+
+var originTokens = &tokenTracker{
+	tokens: map[string]originToken{},
+}
+
+// repeated records the token received by a probe, returning whether it is the same as that
+// received by the previous probe of the series.
+func (t *tokenTracker) repeated(labels probeLabels, token string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := strings.Join(labels.values(), "/")
+	previous, found := t.tokens[key]
+	t.tokens[key] = originToken{labels: labels, token: token}
+
+	return found && previous.token == token
+}
+
+// forget drops the tokens of a series of probes, over each of its addresses if probed
+// separately unless a target address is given.
+func (t *tokenTracker) forget(labels probeLabels) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for key, previous := range t.tokens {
+		if seriesMatches(previous.labels, labels) {
+			delete(t.tokens, key)
+		}
+	}
+}
+
+// newNonce returns a random value for an origin to echo back, so that a response can be
+// matched to the request it answers.
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce) // Best effort, a repeat is only as likely as with tokens
+	return hex.EncodeToString(nonce)
+}
+
+// cacheInspection is what the headers of a response tell us about any caches or proxies it
+// passed through on its way from the origin.
+type cacheInspection struct {
+	Cached        bool // Served from a cache rather than by the origin
+	Via           string
+	XCache        string
+	CFCacheStatus string
+}
+
+// Statuses of Cloudflare for responses it served from its cache
+var cfCachedStatuses = map[string]bool{
+	"HIT":         true,
+	"STALE":       true,
+	"UPDATING":    true,
+	"REVALIDATED": true,
+}
+
+// inspectCacheHeaders looks for the headers caches add to responses they serve. Age is set
+// by any cache following RFC 7234, while X-Cache is set by Squid, Varnish, Fastly and many
+// transparent caches, and CF-Cache-Status by Cloudflare.
+func inspectCacheHeaders(header http.Header) cacheInspection {
+	inspection := cacheInspection{
+		Via:           header.Get("Via"),
+		XCache:        header.Get("X-Cache"),
+		CFCacheStatus: header.Get("CF-Cache-Status"),
+	}
+
+	if age, err := strconv.ParseInt(strings.TrimSpace(header.Get("Age")), 10, 64); err == nil && age > 0 {
+		inspection.Cached = true
+	}
+	if strings.Contains(strings.ToUpper(inspection.XCache), "HIT") {
+		inspection.Cached = true
+	}
+	if cfCachedStatuses[strings.ToUpper(strings.TrimSpace(inspection.CFCacheStatus))] {
+		inspection.Cached = true
+	}
+
+	return inspection
+}
+
+// servedByIntermediary returns whether anything other than the origin is known to have
+// handled the response, by caching it or by proxying it.
+func (c cacheInspection) servedByIntermediary() bool {
+	return c.Cached || c.Via != ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// The number of recent samples the clock filter of each series picks from, as in the clock
+// filter of NTP.
+const clockFilterSamples = 8
+
+// clockSample is the offset of the clock of an origin from that of the leaf, as measured by
+// a single exchange of timestamps, and the round trip delay of the exchange excluding the
+// time the origin took to respond.
+type clockSample struct {
+	Offset time.Duration
+	Delay  time.Duration
+}
+
+// errorBound is the most the offset of the sample can be wrong by. The offset assumes the
+// request and the response took as long as each other, and is off by half the delay at
+// worst, where one of them took all of it.
+func (s clockSample) errorBound() time.Duration {
+	return s.Delay / 2
+}
+
+// newClockSample computes the offset and delay of an exchange with the four timestamps of
+// NTP: the leaf sending the request, the origin receiving it, the origin sending its
+// response and the leaf receiving that. It returns false where the timestamps are
+// inconsistent, such as when either clock was stepped during the exchange.
+func newClockSample(sent, received, transmitted, arrived time.Time) (clockSample, bool) {
+	t1, t2, t3, t4 := sent.UnixNano(), received.UnixNano(), transmitted.UnixNano(), arrived.UnixNano()
+
+	sample := clockSample{
+		Offset: time.Duration(((t2 - t1) + (t3 - t4)) / 2),
+		Delay:  time.Duration((t4 - t1) - (t3 - t2)),
+	}
+	if sample.Delay < 0 || t3 < t2 {
+		return clockSample{}, false
+	}
+
+	return sample, true
+}
+
+// originClockSample returns the sample taken by an advanced probe, if the origin responded
+// with the timestamps of an exchange which started with the time the leaf sent.
+func originClockSample(rsp *types.OriginResponse, leafTime int64, sent, arrived time.Time) (clockSample, bool) {
+	if rsp.ReceiveTime == 0 || rsp.TransmitTime == 0 || rsp.LeafTime != leafTime {
+		return clockSample{}, false
+	}
+
+	return newClockSample(sent, time.Unix(0, rsp.ReceiveTime), time.Unix(0, rsp.TransmitTime), arrived)
+}
+
+// clockFilter keeps the most recent samples of each series of probes, and picks that with
+// the lowest delay among them. Queueing on the way to and from an origin adds to the delay
+// of an exchange and throws its offset off, so the sample with the lowest delay is the one
+// which was least affected.
+type clockFilter struct {
+	mu     sync.Mutex
+	series map[string]clockSeries
+}
+
+// clockSeries is the most recent samples of a series of probes.
+type clockSeries struct {
+	labels  probeLabels
+	samples []clockSample
+}
+
+var originClocks = &clockFilter{
+	series: map[string]clockSeries{},
+}
+
+// add records the latest sample of a series, returning the sample with the lowest delay
+// among those kept.
+func (f *clockFilter) add(labels probeLabels, sample clockSample) clockSample {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.Join(labels.values(), "/")
+	samples := append(f.series[key].samples, sample)
+	if len(samples) > clockFilterSamples {
+		samples = samples[len(samples)-clockFilterSamples:]
+	}
+	f.series[key] = clockSeries{labels: labels, samples: samples}
+
+	best := samples[0]
+	for _, s := range samples[1:] {
+		if s.Delay < best.Delay {
+			best = s
+		}
+	}
+
+	return best
+}
+
+// forget drops the samples of a series of probes, over each of its addresses if probed
+// separately unless a target address is given.
+func (f *clockFilter) forget(labels probeLabels) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for key, series := range f.series {
+		if seriesMatches(series.labels, labels) {
+			delete(f.series, key)
+		}
+	}
+}
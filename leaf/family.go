@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// Families which probes are run over, and labelled with. Origins probed over both families
+// are probed once over each.
+var probeFamilies = []string{types.IPFamilyAny, types.IPFamilyIPv4, types.IPFamilyIPv6}
+
+// originFamilies returns the families an origin is probed over, one probe each. Happy
+// eyeballs probes may connect over either family.
+func originFamilies(origin types.OriginEntry) []string {
+	switch origin.IPFamily {
+	case types.IPFamilyIPv4, types.IPFamilyIPv6:
+		return []string{origin.IPFamily}
+	case types.IPFamilyBoth:
+		return []string{types.IPFamilyIPv4, types.IPFamilyIPv6}
+	default:
+		return []string{types.IPFamilyAny}
+	}
+}
+
+// familyNetwork restricts a network such as tcp to a family, as tcp4 or tcp6.
+func familyNetwork(network, family string) string {
+	switch family {
+	case types.IPFamilyIPv4:
+		return network + "4"
+	case types.IPFamilyIPv6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// familyDialContext dials over the given family only, for use by transports shared by
+// every origin. Any address pinned in the context is dialled instead of the hostname, from
+// any source and through any proxy set in the context, in which case the family is that of
+// the connection to the proxy.
+func familyDialContext(dialer *net.Dialer, family string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return sourceDialer(ctx, dialer, network).DialContext(ctx, familyNetwork(network, family), address)
+	}
+
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if ctx.Value(proxyKey{}) != nil {
+			return dialProxy(ctx, dial, network, pinAddress(ctx, address))
+		}
+
+		return dial(ctx, network, pinAddress(ctx, address))
+	}
+}
+
+// resolveProbeTarget resolves the hostname of an origin to an address of the given family,
+// preferring IPv4 addresses if either family will do.
+func resolveProbeTarget(ctx context.Context, hostname, family string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	var fallback net.IP
+	for _, addr := range addrs {
+		switch {
+		case family == types.IPFamilyAny && ipFamily(addr.IP) == types.IPFamilyIPv4:
+			return addr.IP, nil
+		case family == types.IPFamilyAny && fallback == nil:
+			fallback = addr.IP
+		case ipFamily(addr.IP) == family:
+			return addr.IP, nil
+		}
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, terrors.NotFound("address", fmt.Sprintf("No %s addresses found for %s", family, hostname), nil)
+}
+
+// ipFamily returns the family of an address.
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return types.IPFamilyIPv4
+	}
+
+	return types.IPFamilyIPv6
+}
+
+// addrFamily returns the family of a host:port address, if it is an IP address.
+func addrFamily(address string) (string, bool) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", false
+	}
+
+	return ipFamily(ip), true
+}
@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/monzo/terrors"
+	"golang.org/x/sys/unix"
+)
+
+// listenICMP opens a socket for sending ICMP echo requests, preferring an unprivileged ICMP
+// datagram socket, which Linux allows for groups within net.ipv4.ping_group_range. If that
+// is not allowed, we fall back to a raw socket, which requires CAP_NET_RAW. The returned
+// bool is true if the socket is raw.
+func listenICMP(ctx context.Context, v6, dontFragment bool) (net.PacketConn, bool, error) {
+	conn, err := listenICMPDatagram(ctx, v6, dontFragment)
+	if err == nil {
+		return conn, false, nil
+	}
+
+	network := "ip4:icmp"
+	if v6 {
+		network = "ip6:ipv6-icmp"
+	}
+
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = setICMPSocketOptions(int(fd), v6, dontFragment)
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	lc, address := sourceListenConfig(ctx, lc, "")
+	rawConn, rawErr := lc.ListenPacket(ctx, network, address)
+	if rawErr != nil {
+		return nil, false, terrors.Forbidden("icmp_socket", "Cannot open an unprivileged or raw ICMP socket", map[string]string{
+			"datagram_error": err.Error(),
+			"raw_error":      rawErr.Error(),
+		})
+	}
+
+	return rawConn, true, nil
+}
+
+func listenICMPDatagram(ctx context.Context, v6, dontFragment bool) (net.PacketConn, error) {
+	family, proto := unix.AF_INET, unix.IPPROTO_ICMP
+	if v6 {
+		family, proto = unix.AF_INET6, unix.IPPROTO_ICMPV6
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	if err := setICMPSocketOptions(fd, v6, dontFragment); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	source := contextSource(ctx)
+	if err := bindSocket(fd, source); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	if err := bindSocketAddress(fd, source, v6); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	// The file holds its own duplicate of the socket, so it is closed once wrapped
+	f := os.NewFile(uintptr(fd), "icmp")
+	defer f.Close()
+
+	return net.FilePacketConn(f)
+}
+
+func setICMPSocketOptions(fd int, v6, dontFragment bool) error {
+	if !dontFragment {
+		return nil
+	}
+
+	if v6 {
+		return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_DONTFRAG, 1))
+	}
+
+	return os.NewSyscallError("setsockopt", unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO))
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/monzo/terrors"
+)
+
+// ICMP probes rely on Linux unprivileged ICMP sockets and socket options, and the leaf is
+// only built for Linux.
+func listenICMP(ctx context.Context, v6, dontFragment bool) (net.PacketConn, bool, error) {
+	return nil, false, terrors.InternalService("icmp_unsupported", "ICMP probes are only supported on Linux", nil)
+}
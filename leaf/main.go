@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -78,6 +79,51 @@ func main() {
 		panic(err)
 	}
 
+	// Probe origins through a proxy unless they have their own. The config itself is loaded
+	// through any proxy set in HTTPS_PROXY as usual.
+	if os.Getenv("OXCROSS_LEAF_PROXY") != "" {
+		proxyURL, err := types.ParseProxy(os.Getenv("OXCROSS_LEAF_PROXY"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_PROXY is invalid: %v", err)
+			panic(err)
+		}
+		leafProxy = proxyURL
+		slog.Info(ctx, "Oxcross probing origins through %s proxy %s", proxyURL.Scheme, proxyURL.Host)
+	}
+
+	// Probe origins from each source of a leaf with several uplinks or addresses
+	if os.Getenv("OXCROSS_LEAF_SOURCES") != "" {
+		sources, err := parseProbeSources(os.Getenv("OXCROSS_LEAF_SOURCES"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_SOURCES is invalid: %v", err)
+			panic(err)
+		}
+		probeSources = sources
+		slog.Info(ctx, "Oxcross probing origins from %d sources", len(sources))
+	}
+
+	// Sign probes for origins which only serve known leaves
+	if os.Getenv("OXCROSS_LEAF_SIGNING_KEY") != "" {
+		signer, err := types.ParseSigningKey(os.Getenv("OXCROSS_LEAF_SIGNING_KEY"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_SIGNING_KEY is invalid: %v", err)
+			panic(err)
+		}
+		leafSigner = signer
+		slog.Info(ctx, "Oxcross signing probes as leaf %s", leafID)
+	}
+
+	// Require responses of advanced origins to be signed, unless they have their own key
+	if os.Getenv("OXCROSS_LEAF_ORIGIN_KEY") != "" {
+		verifier, err := types.ParseVerifyKey(os.Getenv("OXCROSS_LEAF_ORIGIN_KEY"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_ORIGIN_KEY is invalid: %v", err)
+			panic(err)
+		}
+		leafOriginKey = verifier
+		slog.Info(ctx, "Oxcross verifying signatures of advanced origins")
+	}
+
 	configBody, err := loadConfig(ctx)
 	if err != nil {
 		slog.Critical(ctx, "Oxcross cannot start as config load failed: %v", err)
@@ -92,15 +138,77 @@ func main() {
 
 	setConfig(*c)
 
+	// Send each probe result to sinks as soon as it is known, before probes start
+	if os.Getenv("OXCROSS_LEAF_SINKS") != "" {
+		sinks, err := parseSinkConfigs(os.Getenv("OXCROSS_LEAF_SINKS"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_SINKS is invalid: %v", err)
+			panic(err)
+		}
+		if err := startSinks(ctx, sinks); err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as a sink cannot be opened: %v", err)
+			panic(err)
+		}
+		slog.Info(ctx, "Oxcross sending probe results to %d sinks", len(sinks))
+	}
+
+	// Log each probe result on disk, to be queried from the metrics server
+	if os.Getenv("OXCROSS_LEAF_RESULT_LOG") != "" {
+		resultLog, err := parseResultLogConfig(os.Getenv("OXCROSS_LEAF_RESULT_LOG"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_RESULT_LOG is invalid: %v", err)
+			panic(err)
+		}
+		if err := startResultLog(ctx, resultLog); err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as the result log in %s cannot be opened: %v", resultLog.Dir, err)
+			panic(err)
+		}
+		slog.Info(ctx, "Oxcross logging probe results to %s", resultLog.Dir)
+	}
+
 	// Initialize client
 	if err = initProbes(ctx); err != nil {
 		slog.Critical(ctx, "Oxcross error initializing client: %v, cannot continue", err)
 		panic(err)
 	}
 
-	// Initialize metrics server
+	// Initialize metrics server, which only serves metrics for Prometheus to scrape unless
+	// they are only exported elsewhere.
+	if os.Getenv("OXCROSS_LEAF_PROMETHEUS") != "" {
+		enabled, err := strconv.ParseBool(os.Getenv("OXCROSS_LEAF_PROMETHEUS"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_PROMETHEUS is invalid: %v", err)
+			panic(err)
+		}
+		prometheusEndpoint = enabled
+	}
 	initMetricsServer()
 
+	// Push metrics to a remote write receiver, for leaves which cannot be scraped
+	if os.Getenv("OXCROSS_LEAF_REMOTE_WRITE") != "" {
+		remoteWrite, err := parseRemoteWriteConfig(os.Getenv("OXCROSS_LEAF_REMOTE_WRITE"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_REMOTE_WRITE is invalid: %v", err)
+			panic(err)
+		}
+		if err := startRemoteWrite(ctx, remoteWrite); err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as the remote write buffer in %s cannot be opened: %v", remoteWrite.Dir, err)
+			panic(err)
+		}
+		slog.Info(ctx, "Oxcross pushing metrics every %d seconds through %s", remoteWrite.Interval, remoteWrite.Dir)
+	}
+
+	// Export metrics to an OpenTelemetry collector
+	if os.Getenv("OXCROSS_LEAF_OTLP") != "" {
+		otlp, err := parseOTLPConfig(os.Getenv("OXCROSS_LEAF_OTLP"))
+		if err != nil {
+			slog.Critical(ctx, "Oxcross cannot start as OXCROSS_LEAF_OTLP is invalid: %v", err)
+			panic(err)
+		}
+		startOTLPExport(ctx, otlp)
+		slog.Info(ctx, "Oxcross exporting metrics over OTLP every %d seconds", otlp.Interval)
+	}
+
 	// Automatically reload config
 	configTicker := time.NewTicker(time.Duration(configReloadInterval) * time.Second)
 	go func() {
@@ -118,6 +226,7 @@ func main() {
 			}
 
 			setConfig(*c)
+			probeScheduler.reschedule(*c)
 			slog.Debug(ctx, "Reloaded config at %s", time.Now().Format(time.RFC3339), nil)
 		}
 	}()
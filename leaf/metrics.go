@@ -6,12 +6,15 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/monzo/slog"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 
 	"github.com/chongyangshi/oxcross/types"
 )
@@ -24,54 +27,722 @@ const (
 var (
 	lastRestartTime time.Time
 	recentRestarts  int
+
+	// Whether metrics are served for Prometheus to scrape, rather than only exported
+	prometheusEndpoint = true
 )
 
+// infoSeries tracks the label values last set on an info metric for each probe, so that
+// the previous series can be removed when the information it carries changes.
+type infoSeries struct {
+	vec    *prometheus.GaugeVec
+	mu     sync.Mutex
+	labels map[probeLabels][]string
+}
+
+func newInfoSeries(vec *prometheus.GaugeVec) *infoSeries {
+	return &infoSeries{
+		vec:    vec,
+		labels: map[probeLabels][]string{},
+	}
+}
+
+func (i *infoSeries) set(labels probeLabels, info ...string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if previous, found := i.labels[labels]; found {
+		i.vec.DeleteLabelValues(previous...)
+	}
+
+	values := labels.values(info...)
+	i.vec.WithLabelValues(values...).Set(1)
+	i.labels[labels] = values
+}
+
+// forget deletes the series last set for a probe, or for all its addresses or resolvers.
+func (i *infoSeries) forget(labels probeLabels) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for series, values := range i.labels {
+		if seriesMatches(series, labels) {
+			i.vec.DeleteLabelValues(values...)
+			delete(i.labels, series)
+		}
+	}
+}
+
+// probeLabels identifies the series which the outcome of a probe is recorded against.
+type probeLabels struct {
+	OriginID   string
+	SourceID   string
+	Source     string // Only set for leaves probing from several sources
+	Resolver   string // Only set for DNS origins
+	IPFamily   string
+	TargetIP   string // Only set for origins probing each of their addresses separately
+	Connection string // Only set for HTTP origins
+}
+
+// Names of the labels identifying a probe, in the same order as probeLabels.values
+var probeLabelNames = []string{"origin_id", "source_id", "source", "resolver", "ip_family", "target_ip", "connection"}
+
+func withProbeLabelNames(extra ...string) []string {
+	return append(append([]string{}, probeLabelNames...), extra...)
+}
+
+func (l probeLabels) values(extra ...string) []string {
+	return append([]string{l.OriginID, l.SourceID, l.Source, l.Resolver, l.IPFamily, l.TargetIP, l.Connection}, extra...)
+}
+
+// Individual phases of a probe are usually much shorter than the whole round trip
+var phaseTimingBuckets = []float64{0, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2}
+
 var (
 	probeTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: "oxcross_leaf",
 		Name:      "probe_timings",
 		Help:      "Record the timing of a successful probe to an origin",
 		Buckets:   []float64{0, 0.05, 0.1, 0.5, 1, 2},
-	}, []string{"origin_id", "source_id"})
+	}, withProbeLabelNames("protocol"))
+	probeDNSTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "probe_dns_timings",
+		Help:      "Record the time taken to resolve the hostname of an origin during a successful probe",
+		Buckets:   phaseTimingBuckets,
+	}, withProbeLabelNames("protocol"))
+	probeConnectTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "probe_connect_timings",
+		Help:      "Record the time taken to establish a TCP connection to an origin during a successful probe",
+		Buckets:   phaseTimingBuckets,
+	}, withProbeLabelNames("protocol"))
+	probeProxyTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "probe_proxy_timings",
+		Help:      "Record the time taken for a proxy to open a tunnel to an origin during a successful probe",
+		Buckets:   phaseTimingBuckets,
+	}, withProbeLabelNames("protocol"))
+	probeTLSTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "probe_tls_handshake_timings",
+		Help:      "Record the time taken to complete the TLS handshake with an origin during a successful probe",
+		Buckets:   phaseTimingBuckets,
+	}, withProbeLabelNames("protocol"))
+	probeServerTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "probe_server_timings",
+		Help:      "Record the time between a request being sent and the first response byte from an origin (TTFB)",
+		Buckets:   phaseTimingBuckets,
+	}, withProbeLabelNames("protocol"))
+	probeTransferTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "probe_transfer_timings",
+		Help:      "Record the time taken to receive the response body from an origin after its first byte",
+		Buckets:   phaseTimingBuckets,
+	}, withProbeLabelNames("protocol"))
 	probeResults = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "oxcross_leaf",
 		Name:      "probe_results",
 		Help:      "Record the result of an attempted probe to an origin",
-	}, []string{"origin_id", "source_id", "result", "reason"})
+	}, withProbeLabelNames("result", "reason", "status_code"))
 	originTimeDrifts = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "oxcross_leaf",
 		Name:      "origin_time_drift",
 		Help:      "Record the perceived timedrift of the origin server",
-	}, []string{"origin_id", "source_id"})
+	}, probeLabelNames)
 	originStatus = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "oxcross_leaf",
 		Name:      "origin_status",
 		Help:      "Record the current status of an origin from the perspective of the probe",
-	}, []string{"origin_id", "source_id", "result", "reason"})
+	}, withProbeLabelNames("result", "reason", "status_code"))
+	originCertExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_tls_cert_expiry_days",
+		Help:      "Record the number of days remaining before the certificate presented by an origin expires",
+	}, probeLabelNames)
+	originCertSANMatch = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_tls_cert_san_match",
+		Help:      "Record whether the certificate presented by an origin is valid for its hostname",
+	}, probeLabelNames)
+	originCertVerified = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_tls_cert_verified",
+		Help:      "Record whether the certificate chain presented by an origin passed verification",
+	}, probeLabelNames)
+	originOCSPStapled = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_tls_ocsp_stapled",
+		Help:      "Record whether an origin stapled an OCSP response during the TLS handshake",
+	}, probeLabelNames)
+	originTLSInfo = newInfoSeries(promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_tls_info",
+		Help:      "Record the certificate and TLS session most recently seen from an origin",
+	}, withProbeLabelNames("issuer", "subject", "fingerprint", "tls_version", "cipher_suite")))
+	udpPacketsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "udp_packets_sent",
+		Help:      "Record the number of packets sent to the echo responder of a UDP origin",
+	}, probeLabelNames)
+	udpPacketsLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "udp_packets_lost",
+		Help:      "Record the number of packets sent to a UDP origin which were never echoed back",
+	}, probeLabelNames)
+	udpPacketsDuplicated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "udp_packets_duplicated",
+		Help:      "Record the number of duplicate replies received from a UDP origin",
+	}, probeLabelNames)
+	udpPacketsReordered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "udp_packets_reordered",
+		Help:      "Record the number of replies from a UDP origin which arrived after a later packet's reply",
+	}, probeLabelNames)
+	udpLossRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "udp_loss_ratio",
+		Help:      "Record the proportion of packets lost in the last burst sent to a UDP origin",
+	}, probeLabelNames)
+	udpRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "udp_rtt",
+		Help:      "Record the minimum, average and maximum round trip times in the last burst sent to a UDP origin",
+	}, withProbeLabelNames("stat"))
+	udpJitter = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "udp_jitter",
+		Help:      "Record the RFC 3550 style jitter of round trip times in the last burst sent to a UDP origin",
+	}, probeLabelNames)
+	icmpPacketsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "icmp_packets_sent",
+		Help:      "Record the number of echo requests sent to an ICMP origin",
+	}, probeLabelNames)
+	icmpPacketsLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "icmp_packets_lost",
+		Help:      "Record the number of echo requests sent to an ICMP origin which were never answered",
+	}, probeLabelNames)
+	icmpLossRatio = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "icmp_loss_ratio",
+		Help:      "Record the proportion of echo requests lost in the last burst sent to an ICMP origin",
+	}, probeLabelNames)
+	icmpRTT = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "icmp_rtt",
+		Help:      "Record the round trip time of each echo reply from an ICMP origin",
+		Buckets:   phaseTimingBuckets,
+	}, probeLabelNames)
+	icmpJitter = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "icmp_jitter",
+		Help:      "Record the RFC 3550 style jitter of round trip times in the last burst sent to an ICMP origin",
+	}, probeLabelNames)
+	icmpReplyTTL = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "icmp_reply_ttl",
+		Help:      "Record the TTL or hop limit of the latest echo reply from an ICMP origin",
+	}, probeLabelNames)
+	tracerouteHopCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "traceroute_hop_count",
+		Help:      "Record the number of hops in the latest path traced to a traceroute origin",
+	}, probeLabelNames)
+	tracerouteHopRTT = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "traceroute_hop_rtt",
+		Help:      "Record the round trip time to each hop which replied in the latest path traced to a traceroute origin",
+	}, withProbeLabelNames("hop"))
+	traceroutePathChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "traceroute_path_changes",
+		Help:      "Record the number of times the path traced to a traceroute origin has changed",
+	}, probeLabelNames)
+	traceroutePathInfo = newInfoSeries(promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "traceroute_path_info",
+		Help:      "Record the fingerprint of the latest path traced to a traceroute origin",
+	}, withProbeLabelNames("fingerprint")))
+	happyEyeballsWins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "happy_eyeballs_wins",
+		Help:      "Record the address family which won the race to connect to an origin probed with happy eyeballs",
+	}, withProbeLabelNames("winner"))
+	warmReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "warm_reconnects",
+		Help:      "Record the persistent connection to an origin probed over warm connections having to be re-established",
+	}, probeLabelNames)
+	originAddressCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_addresses",
+		Help:      "Record the number of addresses the hostname of an origin probing each of its addresses resolves to",
+	}, probeLabelNames)
+	originAddressChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_address_changes",
+		Help:      "Record addresses being added to or removed from those the hostname of an origin resolves to",
+	}, withProbeLabelNames("change"))
+	throughputBits = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "throughput_bits_per_second",
+		Help:      "Record the throughput achieved by the last transfer to or from a throughput origin, in each direction",
+	}, withProbeLabelNames("direction"))
+	throughputCompletionTimings = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "throughput_completion_timings",
+		Help:      "Record the time taken to complete a transfer to or from a throughput origin, including connecting",
+		Buckets:   []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	}, withProbeLabelNames("direction"))
+	throughputBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "throughput_bytes",
+		Help:      "Record the bytes transferred to or from a throughput origin, to keep track of the data used",
+	}, withProbeLabelNames("direction"))
+	originClockOffset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_clock_offset_seconds",
+		Help:      "Record the offset of the clock of an origin from that of the leaf, from the sample with the lowest delay among recent probes",
+	}, probeLabelNames)
+	originClockDelay = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_clock_delay_seconds",
+		Help:      "Record the round trip delay of the sample the clock offset of an origin was taken from",
+	}, probeLabelNames)
+	originClockErrorBound = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_clock_error_bound_seconds",
+		Help:      "Record the most the clock offset of an origin can be wrong by",
+	}, probeLabelNames)
+	staleResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "stale_responses",
+		Help:      "Record responses from an advanced origin which were not to the request sent, by the check which found them",
+	}, withProbeLabelNames("check"))
+	originServedByIntermediary = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_served_by_intermediary",
+		Help:      "Record whether the last response from an origin was served by a cache or proxy rather than the origin itself",
+	}, probeLabelNames)
+	originIntermediaryInfo = newInfoSeries(promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "origin_intermediary_info",
+		Help:      "Record the cache and proxy headers most recently seen on a response from an origin",
+	}, withProbeLabelNames("via", "x_cache", "cf_cache_status")))
+	dnsAnswerTTL = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "dns_answer_ttl",
+		Help:      "Record the lowest TTL among the answers returned by a resolver for a DNS origin",
+	}, probeLabelNames)
+	dnsAnswerInfo = newInfoSeries(promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "dns_answer_info",
+		Help:      "Record the response code and answers most recently returned by a resolver for a DNS origin",
+	}, withProbeLabelNames("rcode", "answers")))
+	otlpDataPointsSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "otlp_data_points_sent",
+		Help:      "Record the number of data points exported to the OTLP collector",
+	})
+	otlpExportFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "otlp_export_failures",
+		Help:      "Record failures to export metrics to the OTLP collector",
+	})
+	remoteWriteQueueBatches = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "remote_write_queue_batches",
+		Help:      "Record the number of batches of samples buffered on disk waiting to be pushed to the remote write receiver",
+	})
+	remoteWriteQueueBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "remote_write_queue_bytes",
+		Help:      "Record the size of the batches buffered on disk waiting to be pushed to the remote write receiver",
+	})
+	remoteWriteSamplesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "remote_write_samples_sent",
+		Help:      "Record the number of samples accepted by the remote write receiver",
+	})
+	remoteWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "remote_write_send_failures",
+		Help:      "Record failures to push a batch to the remote write receiver, by whether the batch is retried",
+	}, []string{"retryable"})
+	remoteWriteDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "remote_write_batches_dropped",
+		Help:      "Record batches of samples dropped without being pushed to the remote write receiver, by reason",
+	}, []string{"reason"})
+	resultLogFiles = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "result_log_files",
+		Help:      "Record the number of files of probe results logged on disk",
+	})
+	resultLogBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "result_log_bytes",
+		Help:      "Record the size of the files of probe results logged on disk",
+	})
+	sinkResultsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "sink_results_dropped",
+		Help:      "Record probe results dropped as a sink could not keep up with them",
+	}, []string{"sink"})
+	sinkSendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "oxcross_leaf",
+		Name:      "sink_send_failures",
+		Help:      "Record failures to send probe results to a sink",
+	}, []string{"sink"})
 )
 
-func registerProbeTiming(originID, sourceID string, timing float64) {
-	probeTimings.WithLabelValues(originID, sourceID).Observe(timing)
+// probeMetric is a metric labelled by probe, from which the series of a probe can be deleted.
+type probeMetric interface {
+	prometheus.Collector
+	Delete(prometheus.Labels) bool
+}
+
+// Metrics labelled by probe, whose series are deleted along with the probes they belong to
+var probeMetrics = []probeMetric{
+	probeTimings, probeDNSTimings, probeConnectTimings, probeProxyTimings, probeTLSTimings,
+	probeServerTimings, probeTransferTimings, probeResults, originTimeDrifts, originStatus,
+	originCertExpiry, originCertSANMatch, originCertVerified, originOCSPStapled, udpPacketsSent,
+	udpPacketsLost, udpPacketsDuplicated, udpPacketsReordered, udpLossRatio, udpRTT, udpJitter,
+	icmpPacketsSent, icmpPacketsLost, icmpLossRatio, icmpRTT, icmpJitter, icmpReplyTTL,
+	tracerouteHopCount, tracerouteHopRTT, traceroutePathChanges, happyEyeballsWins,
+	warmReconnects, originAddressCount, originAddressChanges, throughputBits,
+	throughputCompletionTimings, throughputBytes, originClockOffset, originClockDelay,
+	originClockErrorBound, staleResponses, originServedByIntermediary, dnsAnswerTTL,
+}
+
+// Info metrics labelled by probe, which delete the series they last set themselves
+var probeInfoMetrics = []*infoSeries{originTLSInfo, traceroutePathInfo, originIntermediaryInfo, dnsAnswerInfo}
+
+// deleteProbeMetrics deletes the series of a probe which has been stopped from every metric,
+// or those of all its addresses or resolvers if none is given, so that an origin or address
+// which has gone away does not keep exporting its last values.
+func deleteProbeMetrics(labels probeLabels) {
+	for _, metric := range probeMetrics {
+		for _, series := range matchingSeries(metric, labels) {
+			metric.Delete(series)
+		}
+	}
+
+	for _, info := range probeInfoMetrics {
+		info.forget(labels)
+	}
+}
+
+// matchingSeries finds the label values of the series of a metric which belong to a probe.
+// They are deleted only once collected, as collecting holds the lock deleting needs.
+func matchingSeries(metric prometheus.Collector, labels probeLabels) []prometheus.Labels {
+	metrics := make(chan prometheus.Metric)
+	go func() {
+		metric.Collect(metrics)
+		close(metrics)
+	}()
+
+	matching := []prometheus.Labels{}
+	for m := range metrics {
+		written := &dto.Metric{}
+		if err := m.Write(written); err != nil {
+			continue
+		}
+
+		series := prometheus.Labels{}
+		for _, pair := range written.GetLabel() {
+			series[pair.GetName()] = pair.GetValue()
+		}
+		if seriesMatches(seriesLabels(series), labels) {
+			matching = append(matching, series)
+		}
+	}
+
+	return matching
+}
+
+// seriesLabels reads the labels of the probe a series belongs to.
+func seriesLabels(series prometheus.Labels) probeLabels {
+	return probeLabels{
+		OriginID:   series["origin_id"],
+		SourceID:   series["source_id"],
+		Source:     series["source"],
+		Resolver:   series["resolver"],
+		IPFamily:   series["ip_family"],
+		TargetIP:   series["target_ip"],
+		Connection: series["connection"],
+	}
+}
+
+// Timings of HTTP probes are labelled with the protocol negotiated, which is empty for other
+// probes. Phases which did not take place during the probe are not recorded, so that plain
+// HTTP origins, origins addressed by IP or TCP origins do not skew the histograms with zeroes.
+func registerProbeTimings(labels probeLabels, protocol string, timing float64, phases probePhases) {
+	probeTimings.WithLabelValues(labels.values(protocol)...).Observe(timing)
+
+	if phases.DNS > 0 {
+		probeDNSTimings.WithLabelValues(labels.values(protocol)...).Observe(phases.DNS.Seconds())
+	}
+	if phases.Connect > 0 {
+		probeConnectTimings.WithLabelValues(labels.values(protocol)...).Observe(phases.Connect.Seconds())
+	}
+	if phases.Proxy > 0 {
+		probeProxyTimings.WithLabelValues(labels.values(protocol)...).Observe(phases.Proxy.Seconds())
+	}
+	if phases.TLS > 0 {
+		probeTLSTimings.WithLabelValues(labels.values(protocol)...).Observe(phases.TLS.Seconds())
+	}
+	if phases.Server > 0 {
+		probeServerTimings.WithLabelValues(labels.values(protocol)...).Observe(phases.Server.Seconds())
+	}
+	if phases.Transfer > 0 {
+		probeTransferTimings.WithLabelValues(labels.values(protocol)...).Observe(phases.Transfer.Seconds())
+	}
+}
+
+func registerProbeResult(labels probeLabels, result bool, reason string) {
+	registerProbeStatus(labels, result, reason, 0)
+}
+
+// The status code is only recorded for HTTP probes which received a response.
+func registerProbeStatus(labels probeLabels, result bool, reason string, statusCode int) {
+	countProbeStatus(labels, result, reason, statusCode)
+	publishProbeResult(probeResult{
+		Labels:     labels,
+		Time:       time.Now(),
+		Result:     result,
+		Reason:     reason,
+		StatusCode: statusCode,
+	})
 }
 
-func registerProbeResult(originID, sourceID string, result bool, reason string) {
-	probeResults.WithLabelValues(originID, sourceID, strconv.FormatBool(result), reason).Add(1)
+func countProbeStatus(labels probeLabels, result bool, reason string, statusCode int) {
+	status := ""
+	if statusCode > 0 {
+		status = strconv.Itoa(statusCode)
+	}
+
+	probeResults.WithLabelValues(labels.values(strconv.FormatBool(result), reason, status)...).Add(1)
 
 	// Also update origin status as a real time value
 	gaugeValue := 1.0
 	if !result {
 		gaugeValue = 0.0
 	}
-	originStatus.WithLabelValues(originID, sourceID, strconv.FormatBool(result), reason).Set(gaugeValue)
+	originStatus.WithLabelValues(labels.values(strconv.FormatBool(result), reason, status)...).Set(gaugeValue)
+}
+
+// Probes which time their round trips record a success along with the timing, so that
+// sinks receive both as one result.
+func registerProbeSuccess(labels probeLabels, statusCode int, protocol string, duration time.Duration, phases probePhases) {
+	countProbeStatus(labels, true, "", statusCode)
+	registerProbeTimings(labels, protocol, duration.Seconds(), phases)
+	publishProbeResult(probeResult{
+		Labels:     labels,
+		Time:       time.Now(),
+		Result:     true,
+		StatusCode: statusCode,
+		Protocol:   protocol,
+		Duration:   duration,
+		Phases:     phases,
+	})
+}
+
+// Only origins probed with happy eyeballs race connections over both families.
+func registerHappyEyeballsWinner(labels probeLabels, origin types.OriginEntry, trace *probeTrace) {
+	if origin.IPFamily != types.IPFamilyHappyEyeballs {
+		return
+	}
+
+	if family, ok := trace.connectedFamily(); ok {
+		happyEyeballsWins.WithLabelValues(labels.values(family)...).Add(1)
+	}
+}
+
+func registerTLSInspection(labels probeLabels, inspection *tlsInspection) {
+	originCertExpiry.WithLabelValues(labels.values()...).Set(inspection.ExpiryDays)
+	originCertSANMatch.WithLabelValues(labels.values()...).Set(boolGauge(inspection.SANMatch))
+	originCertVerified.WithLabelValues(labels.values()...).Set(boolGauge(inspection.Verified))
+	if inspection.Verified {
+		// Whether a response was stapled is only known following a successful handshake
+		originOCSPStapled.WithLabelValues(labels.values()...).Set(boolGauge(inspection.OCSPStapled))
+	}
+
+	originTLSInfo.set(labels, inspection.Issuer, inspection.Subject, inspection.Fingerprint, inspection.Version, inspection.CipherSuite)
+}
+
+func registerUDPBurst(labels probeLabels, result burstResult) {
+	udpPacketsSent.WithLabelValues(labels.values()...).Add(float64(result.Sent))
+	udpPacketsLost.WithLabelValues(labels.values()...).Add(float64(result.Sent - result.Received))
+	udpPacketsDuplicated.WithLabelValues(labels.values()...).Add(float64(result.Duplicates))
+	udpPacketsReordered.WithLabelValues(labels.values()...).Add(float64(result.Reordered))
+
+	if result.Sent > 0 {
+		udpLossRatio.WithLabelValues(labels.values()...).Set(float64(result.Sent-result.Received) / float64(result.Sent))
+	}
+
+	// Round trip times are meaningless if nothing came back
+	if result.Received > 0 {
+		udpRTT.WithLabelValues(labels.values("min")...).Set(result.RTTMin.Seconds())
+		udpRTT.WithLabelValues(labels.values("avg")...).Set(result.RTTAvg.Seconds())
+		udpRTT.WithLabelValues(labels.values("max")...).Set(result.RTTMax.Seconds())
+		udpJitter.WithLabelValues(labels.values()...).Set(result.Jitter.Seconds())
+	}
 }
 
-func registerOriginTimeDrift(originID, sourceID string, timeDirft float64) {
-	originTimeDrifts.WithLabelValues(originID, sourceID).Set(timeDirft)
+func registerICMPBurst(labels probeLabels, result burstResult) {
+	icmpPacketsSent.WithLabelValues(labels.values()...).Add(float64(result.Sent))
+	icmpPacketsLost.WithLabelValues(labels.values()...).Add(float64(result.Sent - result.Received))
+
+	if result.Sent > 0 {
+		icmpLossRatio.WithLabelValues(labels.values()...).Set(float64(result.Sent-result.Received) / float64(result.Sent))
+	}
+
+	for _, rtt := range result.RTTs {
+		icmpRTT.WithLabelValues(labels.values()...).Observe(rtt.Seconds())
+	}
+
+	if result.Received > 0 {
+		icmpJitter.WithLabelValues(labels.values()...).Set(result.Jitter.Seconds())
+	}
+	if result.TTL > 0 {
+		icmpReplyTTL.WithLabelValues(labels.values()...).Set(float64(result.TTL))
+	}
+}
+
+func registerTraceroute(labels probeLabels, path, previous traceroutePath, changed bool) {
+	tracerouteHopCount.WithLabelValues(labels.values()...).Set(float64(len(path.Hops)))
+	traceroutePathInfo.set(labels, path.Fingerprint)
+	if changed {
+		traceroutePathChanges.WithLabelValues(labels.values()...).Add(1)
+	}
+
+	// Hops which no longer reply, or are no longer on the path, should not keep their last RTT
+	replied := map[int]bool{}
+	for _, hop := range path.Hops {
+		if hop.Address == "" {
+			continue
+		}
+		replied[hop.TTL] = true
+		tracerouteHopRTT.WithLabelValues(labels.values(strconv.Itoa(hop.TTL))...).Set(hop.RTT)
+	}
+	for _, hop := range previous.Hops {
+		if hop.Address != "" && !replied[hop.TTL] {
+			tracerouteHopRTT.DeleteLabelValues(labels.values(strconv.Itoa(hop.TTL))...)
+		}
+	}
+}
+
+// Recorded for every warm probe, so that origins which have never reconnected are shown.
+func registerWarmProbe(labels probeLabels, reconnected bool) {
+	warmReconnects.WithLabelValues(labels.values()...).Add(boolGauge(reconnected))
+}
+
+func registerOriginAddresses(labels probeLabels, addresses, added, removed int) {
+	originAddressCount.WithLabelValues(labels.values()...).Set(float64(addresses))
+	originAddressChanges.WithLabelValues(labels.values("added")...).Add(float64(added))
+	originAddressChanges.WithLabelValues(labels.values("removed")...).Add(float64(removed))
+}
+
+func registerThroughput(labels probeLabels, result throughputResult) {
+	throughputBytes.WithLabelValues(labels.values(result.Direction)...).Add(float64(result.Bytes))
+	throughputCompletionTimings.WithLabelValues(labels.values(result.Direction)...).Observe(result.Duration.Seconds())
+	if result.Transfer > 0 {
+		throughputBits.WithLabelValues(labels.values(result.Direction)...).Set(float64(result.Bytes*8) / result.Transfer.Seconds())
+	}
+}
+
+// A stale response was served by an intermediary whether or not it said so in its headers.
+func registerStaleResponse(labels probeLabels, check string, inspection cacheInspection) {
+	staleResponses.WithLabelValues(labels.values(check)...).Add(1)
+	registerCacheInspection(labels, inspection, true)
+}
+
+func registerCacheInspection(labels probeLabels, inspection cacheInspection, stale bool) {
+	originServedByIntermediary.WithLabelValues(labels.values()...).Set(boolGauge(stale || inspection.servedByIntermediary()))
+	originIntermediaryInfo.set(labels, inspection.Via, inspection.XCache, inspection.CFCacheStatus)
+}
+
+func registerDNSAnswer(labels probeLabels, rcode string, answers []string, minTTL uint32) {
+	if len(answers) > 0 {
+		dnsAnswerTTL.WithLabelValues(labels.values()...).Set(float64(minTTL))
+	}
+	dnsAnswerInfo.set(labels, rcode, strings.Join(answers, ","))
+}
+
+// The time drift of origins which send timestamps is their clock offset, so that alerts on
+// it work for origins of either kind.
+func registerOriginClock(labels probeLabels, sample clockSample) {
+	originClockOffset.WithLabelValues(labels.values()...).Set(sample.Offset.Seconds())
+	originClockDelay.WithLabelValues(labels.values()...).Set(sample.Delay.Seconds())
+	originClockErrorBound.WithLabelValues(labels.values()...).Set(sample.errorBound().Seconds())
+	registerOriginTimeDrift(labels, sample.Offset.Seconds())
+}
+
+func registerOTLPExport(points int) {
+	otlpDataPointsSent.Add(float64(points))
+}
+
+func registerOTLPExportFailure() {
+	otlpExportFailures.Add(1)
+}
+
+func registerRemoteWriteQueue(batches int, bytes int64) {
+	remoteWriteQueueBatches.Set(float64(batches))
+	remoteWriteQueueBytes.Set(float64(bytes))
+}
+
+func registerRemoteWriteSent(samples int) {
+	remoteWriteSamplesSent.Add(float64(samples))
+}
+
+func registerRemoteWriteFailure(retryable bool) {
+	remoteWriteFailures.WithLabelValues(strconv.FormatBool(retryable)).Add(1)
+}
+
+func registerRemoteWriteDropped(reason string) {
+	remoteWriteDropped.WithLabelValues(reason).Add(1)
+}
+
+func registerResultLogFiles(files int, bytes int64) {
+	resultLogFiles.Set(float64(files))
+	resultLogBytes.Set(float64(bytes))
+}
+
+func registerSinkDropped(sink string) {
+	sinkResultsDropped.WithLabelValues(sink).Add(1)
+}
+
+func registerSinkFailure(sink string) {
+	sinkSendFailures.WithLabelValues(sink).Add(1)
+}
+
+func registerOriginTimeDrift(labels probeLabels, timeDirft float64) {
+	originTimeDrifts.WithLabelValues(labels.values()...).Set(timeDirft)
+}
+
+func boolGauge(value bool) float64 {
+	if value {
+		return 1.0
+	}
+
+	return 0.0
 }
 
 func initMetricsServer() {
 	ctx := context.Background()
-	http.Handle("/metrics", promhttp.Handler())
+	if prometheusEndpoint {
+		http.Handle("/metrics", promhttp.Handler())
+	}
+	http.HandleFunc("/traceroute", serveTraceroutePaths)
+	if localResults != nil {
+		http.HandleFunc("/results", serveResults)
+		http.HandleFunc("/results/percentiles", serveResultPercentiles)
+	}
 
 	port := types.ProbeMetricsServerPort
 	envPort := os.Getenv("OXCROSS_METRICS_PORT")
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Counters and histograms of the leaf accumulate from when it started
+var leafStartTime = time.Now()
+
+// otlpConfig configures exporting metrics to an OpenTelemetry collector over OTLP/HTTP.
+type otlpConfig struct {
+	URL                string            `json:"url"` // The full URL of the metrics endpoint, ending in /v1/metrics
+	Interval           int               `json:"interval"`
+	Timeout            int               `json:"timeout"`
+	Headers            map[string]string `json:"headers"`             // Such as for authentication
+	ResourceAttributes map[string]string `json:"resource_attributes"` // In addition to those of the leaf
+}
+
+// parseOTLPConfig parses the OTLP exporter config of a leaf, as a JSON object.
+func parseOTLPConfig(config string) (otlpConfig, error) {
+	c := otlpConfig{
+		Interval: 15,
+		Timeout:  10,
+	}
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		return c, terrors.Wrap(err, nil)
+	}
+
+	u, err := url.Parse(c.URL)
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return c, terrors.BadRequest("invalid_otlp", "OTLP url must be an http or https URL", nil)
+	case c.Interval < 1 || c.Timeout < 1:
+		return c, terrors.BadRequest("invalid_otlp", "OTLP interval and timeout must be at least a second", nil)
+	}
+
+	return c, nil
+}
+
+// startOTLPExport exports the metrics of the leaf to the collector every interval. Counters
+// and histograms are exported as cumulative since the leaf started, as they are kept by the
+// leaf, so a failed export loses nothing which the next does not carry.
+func startOTLPExport(ctx context.Context, config otlpConfig) {
+	exporter := &otlpExporter{
+		config:   config,
+		resource: otlpResource(config.ResourceAttributes),
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := exporter.export(ctx, time.Now()); err != nil {
+				registerOTLPExportFailure()
+				slog.Error(ctx, "Error exporting metrics over OTLP: %v", err)
+			}
+		}
+	}()
+}
+
+// otlpResource returns the attributes identifying the leaf as the source of its metrics.
+func otlpResource(extra map[string]string) otlpAttributes {
+	attributes := map[string]string{}
+	for key, value := range extra {
+		attributes[key] = value
+	}
+	attributes["service.name"] = "oxcross-leaf"
+	attributes["service.instance.id"] = leafID
+	attributes["oxcross.leaf_id"] = leafID
+
+	return newOTLPAttributes(attributes)
+}
+
+type otlpExporter struct {
+	config   otlpConfig
+	resource otlpAttributes
+}
+
+func (e *otlpExporter) export(ctx context.Context, now time.Time) error {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		// Whatever could be gathered is still worth exporting
+		slog.Warn(ctx, "Error gathering metrics for OTLP: %v", err)
+	}
+
+	metrics, points := otlpMetrics(families, leafStartTime, now)
+	body, err := json.Marshal(otlpRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResourceAttributes{Attributes: e.resource},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope:   otlpScope{Name: "oxcross-leaf"},
+				Metrics: metrics,
+			}},
+		}},
+	})
+	if err != nil {
+		return terrors.Wrap(err, nil)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.config.Timeout)*time.Second)
+	defer cancel()
+
+	req := typhon.NewRequest(ctx, http.MethodPost, e.config.URL, nil)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	for header, value := range e.config.Headers {
+		req.Header.Set(header, value)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "oxcross-leaf")
+
+	rsp := req.Send().Response()
+	if rsp.Error != nil || rsp.Response == nil {
+		return rsp.Error
+	}
+	rspBody, err := rsp.BodyBytes(true)
+	if err != nil {
+		return terrors.Wrap(err, nil)
+	}
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return terrors.BadResponse("otlp_failed", fmt.Sprintf("Collector responded with status %d: %s", rsp.StatusCode, rspBody), nil)
+	}
+
+	// Collectors can accept some data points while rejecting others
+	result := otlpResponse{}
+	if err := json.Unmarshal(rspBody, &result); err == nil {
+		rejected := strings.Trim(string(result.PartialSuccess.RejectedDataPoints), `"`)
+		if rejected != "" && rejected != "0" {
+			slog.Warn(ctx, "OTLP collector rejected %s data points: %s", rejected, result.PartialSuccess.ErrorMessage)
+		}
+	}
+	registerOTLPExport(points)
+
+	return nil
+}
+
+// otlpMetrics converts gathered metrics to their OTLP equivalents, returning them along with
+// the number of data points among them. Values which are not finite cannot be encoded in
+// JSON, and are left out.
+func otlpMetrics(families []*dto.MetricFamily, start, now time.Time) ([]otlpMetric, int) {
+	startTime := strconv.FormatInt(start.UnixNano(), 10)
+
+	metrics := []otlpMetric{}
+	points := 0
+	for _, family := range families {
+		metric := otlpMetric{
+			Name:        family.GetName(),
+			Description: family.GetHelp(),
+		}
+
+		var numbers []otlpNumberDataPoint
+		var histograms []otlpHistogramDataPoint
+		var summaries []otlpSummaryDataPoint
+		for _, m := range family.GetMetric() {
+			timestamp := now.UnixNano()
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs() * int64(time.Millisecond)
+			}
+			attributes := otlpLabelAttributes(m.GetLabel())
+			pointTime := strconv.FormatInt(timestamp, 10)
+
+			switch family.GetType() {
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				point := otlpHistogramDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: startTime,
+					TimeUnixNano:      pointTime,
+					Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+					Sum:               h.GetSampleSum(),
+				}
+				previous := uint64(0)
+				for _, bucket := range h.GetBucket() {
+					if math.IsInf(bucket.GetUpperBound(), 1) {
+						break
+					}
+					point.ExplicitBounds = append(point.ExplicitBounds, bucket.GetUpperBound())
+					point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(bucket.GetCumulativeCount()-previous, 10))
+					previous = bucket.GetCumulativeCount()
+				}
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+				if isFinite(point.Sum) {
+					histograms = append(histograms, point)
+				}
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				point := otlpSummaryDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: startTime,
+					TimeUnixNano:      pointTime,
+					Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, quantile := range s.GetQuantile() {
+					if isFinite(quantile.GetValue()) {
+						point.QuantileValues = append(point.QuantileValues, otlpQuantileValue{Quantile: quantile.GetQuantile(), Value: quantile.GetValue()})
+					}
+				}
+				if isFinite(point.Sum) {
+					summaries = append(summaries, point)
+				}
+			default:
+				value := m.GetGauge().GetValue()
+				switch family.GetType() {
+				case dto.MetricType_COUNTER:
+					value = m.GetCounter().GetValue()
+				case dto.MetricType_UNTYPED:
+					value = m.GetUntyped().GetValue()
+				}
+				point := otlpNumberDataPoint{
+					Attributes:   attributes,
+					TimeUnixNano: pointTime,
+					AsDouble:     value,
+				}
+				if family.GetType() == dto.MetricType_COUNTER {
+					point.StartTimeUnixNano = startTime
+				}
+				if isFinite(value) {
+					numbers = append(numbers, point)
+				}
+			}
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{DataPoints: numbers, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			points += len(numbers)
+		case dto.MetricType_HISTOGRAM:
+			metric.Histogram = &otlpHistogram{DataPoints: histograms, AggregationTemporality: otlpCumulative}
+			points += len(histograms)
+		case dto.MetricType_SUMMARY:
+			metric.Summary = &otlpSummary{DataPoints: summaries}
+			points += len(summaries)
+		default:
+			metric.Gauge = &otlpGauge{DataPoints: numbers}
+			points += len(numbers)
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, points
+}
+
+func isFinite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
+
+// otlpLabelAttributes converts the labels of a metric to attributes, leaving out those with
+// empty values as scrapes do.
+func otlpLabelAttributes(labels []*dto.LabelPair) otlpAttributes {
+	attributes := map[string]string{}
+	for _, label := range labels {
+		if label.GetValue() != "" {
+			attributes[label.GetName()] = label.GetValue()
+		}
+	}
+
+	return newOTLPAttributes(attributes)
+}
+
+// The ExportMetricsServiceRequest message of OTLP, in its JSON encoding. Integers of 64 bits
+// are encoded as strings, and enums as their values.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResourceAttributes `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics     `json:"scopeMetrics"`
+}
+
+type otlpResourceAttributes struct {
+	Attributes otlpAttributes `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+// Aggregation temporality of sums and histograms accumulated since they started
+const otlpCumulative = 2
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        otlpAttributes `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        otlpAttributes `json:"attributes"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        otlpAttributes      `json:"attributes"`
+	StartTimeUnixNano string              `json:"startTimeUnixNano"`
+	TimeUnixNano      string              `json:"timeUnixNano"`
+	Count             string              `json:"count"`
+	Sum               float64             `json:"sum"`
+	QuantileValues    []otlpQuantileValue `json:"quantileValues"`
+}
+
+type otlpQuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+type otlpAttributes []otlpAttribute
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// newOTLPAttributes returns attributes of string values, sorted by key.
+func newOTLPAttributes(values map[string]string) otlpAttributes {
+	attributes := otlpAttributes{}
+	for key, value := range values {
+		attributes = append(attributes, otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: value}})
+	}
+	sort.Slice(attributes, func(i, j int) bool {
+		return attributes[i].Key < attributes[j].Key
+	})
+
+	return attributes
+}
+
+// otlpResponse is the ExportMetricsServiceResponse message, which reports any data points
+// the collector rejected. Collectors may encode the number of them as a string or a number.
+type otlpResponse struct {
+	PartialSuccess struct {
+		RejectedDataPoints json.RawMessage `json:"rejectedDataPoints"`
+		ErrorMessage       string          `json:"errorMessage"`
+	} `json:"partialSuccess"`
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+const (
+	// Large enough for any response over UDP, as we do not advertise a larger size through EDNS
+	maxUDPResponseBytes = 4096
+
+	// The largest DNS message, whose length fits in the two bytes prefixing it over TCP
+	maxDNSMessageBytes = 65535
+)
+
+const (
+	reasonDNSMalformed = "dns_malformed"
+	reasonNoAnswers    = "dns_no_answers"
+	reasonAnswers      = "dns_answer_mismatch"
+)
+
+var recordTypes = map[string]dnsmessage.Type{
+	"A":     dnsmessage.TypeA,
+	"AAAA":  dnsmessage.TypeAAAA,
+	"CNAME": dnsmessage.TypeCNAME,
+	"MX":    dnsmessage.TypeMX,
+	"NS":    dnsmessage.TypeNS,
+	"TXT":   dnsmessage.TypeTXT,
+}
+
+var rcodeNames = map[dnsmessage.RCode]string{
+	dnsmessage.RCodeSuccess:        "noerror",
+	dnsmessage.RCodeFormatError:    "formerr",
+	dnsmessage.RCodeServerFailure:  "servfail",
+	dnsmessage.RCodeNameError:      "nxdomain",
+	dnsmessage.RCodeNotImplemented: "notimp",
+	dnsmessage.RCodeRefused:        "refused",
+}
+
+// dnsProber probes DNS origins by querying their hostname against each of their resolvers
+// independently, recording the outcome against each resolver.
+type dnsProber struct {
+	clients map[string]typhon.Service // By address family
+}
+
+// dnsAnswer is the outcome of a single query to a resolver.
+type dnsAnswer struct {
+	RCode   dnsmessage.RCode
+	Answers []string // Sorted, and only those of the queried type
+	MinTTL  uint32
+}
+
+// As for HTTP origins, queries over HTTPS are bounded by the timeouts of their contexts.
+func newDNSProber() *dnsProber {
+	dialer := &net.Dialer{
+		KeepAlive: -1 * time.Second, // Disabled
+		DualStack: true,
+	}
+
+	clients := map[string]typhon.Service{}
+	for _, family := range probeFamilies {
+		roundTripper := &http.Transport{
+			DisableKeepAlives: true,
+			DialContext:       familyDialContext(dialer, family),
+		}
+		clients[family] = typhon.HttpService(classifyingTransport{roundTripper}).Filter(typhon.ExpirationFilter)
+	}
+
+	return &dnsProber{
+		clients: clients,
+	}
+}
+
+func (p *dnsProber) probe(ctx context.Context, origin types.OriginEntry, labels probeLabels) error {
+	wg := sync.WaitGroup{}
+	errs := make([]error, len(origin.Resolvers))
+	for i, resolver := range origin.Resolvers {
+		i, resolver := i, resolver // Avoids shadowing
+		resolverLabels := labels
+		resolverLabels.Resolver = resolver
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = p.probeResolver(ctx, origin, resolver, resolverLabels)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *dnsProber) probeResolver(ctx context.Context, origin types.OriginEntry, resolver string, labels probeLabels) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout(origin))
+	defer cancel()
+
+	start := time.Now()
+	answer, err := p.query(ctx, resolver, origin.Hostname, recordTypes[origin.RecordType], labels.IPFamily)
+	if err != nil {
+		registerProbeResult(labels, false, exchangeReason(ctx, err))
+		slog.Error(ctx, "Error querying %s for %s %s: %v", resolver, origin.RecordType, origin.Hostname, err)
+		return err
+	}
+	duration := time.Since(start)
+
+	registerDNSAnswer(labels, rcodeName(answer.RCode), answer.Answers, answer.MinTTL)
+
+	switch {
+	case answer.RCode != dnsmessage.RCodeSuccess:
+		err = terrors.BadResponse("rcode", fmt.Sprintf("Resolver %s returned %s for %s %s", resolver, rcodeName(answer.RCode), origin.RecordType, origin.Hostname), nil)
+		registerProbeResult(labels, false, fmt.Sprintf("dns_%s", rcodeName(answer.RCode)))
+	case len(answer.Answers) == 0:
+		err = terrors.BadResponse(reasonNoAnswers, fmt.Sprintf("Resolver %s returned no answers for %s %s", resolver, origin.RecordType, origin.Hostname), nil)
+		registerProbeResult(labels, false, reasonNoAnswers)
+	case len(origin.ExpectedAnswers) > 0 && !answersMatch(answer.Answers, origin.ExpectedAnswers, origin.RecordType):
+		err = terrors.BadResponse(reasonAnswers, fmt.Sprintf("Resolver %s returned unexpected answers %v for %s %s", resolver, answer.Answers, origin.RecordType, origin.Hostname), nil)
+		registerProbeResult(labels, false, reasonAnswers)
+	}
+	if err != nil {
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	registerProbeSuccess(labels, 0, "", duration, probePhases{})
+
+	return nil
+}
+
+// exchangeReason classifies the failure of an exchange with a resolver. The resolver not
+// replying in time is a DNS timeout, whichever phase of the exchange it happened in.
+func exchangeReason(ctx context.Context, err error) string {
+	if terrors.PrefixMatches(err, terrors.ErrBadResponse, "malformed") {
+		return reasonDNSMalformed
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return reasonDNSTimeout
+	}
+
+	switch reason := classifyError(err); reason {
+	case reasonConnectTimeout, reasonReadTimeout, reasonTimeout:
+		return reasonDNSTimeout
+	case reasonUnknown:
+		return reasonDNSFailure
+	default:
+		return reason
+	}
+}
+
+// query sends a single query to the resolver over its transport, connecting to the resolver
+// over the given family. A UDP response which was truncated is retried over TCP, as a stub
+// resolver would.
+func (p *dnsProber) query(ctx context.Context, resolver, hostname string, recordType dnsmessage.Type, family string) (*dnsAnswer, error) {
+	resolverURL, err := url.Parse(resolver)
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	id, query, err := buildDNSQuery(hostname, recordType)
+	if err != nil {
+		return nil, err
+	}
+
+	var response []byte
+	switch resolverURL.Scheme {
+	case "udp":
+		response, err = p.exchangeUDP(ctx, familyNetwork("udp", family), resolverURL.Host, id, query)
+	case "tcp":
+		response, err = p.exchangeTCP(ctx, familyNetwork("tcp", family), resolverURL.Host, query)
+	case "https":
+		response, err = p.exchangeHTTPS(ctx, p.clients[family], resolver, query)
+	default:
+		err = terrors.BadRequest("invalid_resolver", fmt.Sprintf("Unsupported resolver scheme %s", resolverURL.Scheme), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	answer, truncated, err := parseDNSResponse(id, response, recordType)
+	if err != nil {
+		return nil, err
+	}
+
+	if truncated && resolverURL.Scheme == "udp" {
+		response, err = p.exchangeTCP(ctx, familyNetwork("tcp", family), resolverURL.Host, query)
+		if err != nil {
+			return nil, err
+		}
+		answer, _, err = parseDNSResponse(id, response, recordType)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return answer, nil
+}
+
+func (p *dnsProber) exchangeUDP(ctx context.Context, network, address string, id uint16, query []byte) ([]byte, error) {
+	conn, err := sourceDialer(ctx, &net.Dialer{}, network).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, wrapProbeError(err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, wrapProbeError(err)
+	}
+
+	// Ignore any stray datagrams not in response to our query
+	buf := make([]byte, maxUDPResponseBytes)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, wrapProbeError(err)
+		}
+		if n >= 2 && binary.BigEndian.Uint16(buf[:2]) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+func (p *dnsProber) exchangeTCP(ctx context.Context, network, address string, query []byte) ([]byte, error) {
+	conn, err := sourceDialer(ctx, &net.Dialer{}, network).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, wrapProbeError(err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// Messages over TCP are prefixed with their length
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, wrapProbeError(err)
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, wrapProbeError(err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, wrapProbeError(err)
+	}
+
+	return response, nil
+}
+
+// exchangeHTTPS sends the query to a DNS-over-HTTPS endpoint as described in RFC 8484.
+func (p *dnsProber) exchangeHTTPS(ctx context.Context, client typhon.Service, endpoint string, query []byte) ([]byte, error) {
+	req := typhon.NewRequest(ctx, http.MethodPost, endpoint, nil)
+	req.Body = ioutil.NopCloser(bytes.NewReader(query))
+	req.ContentLength = int64(len(query))
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	rsp := req.SendVia(client).Response()
+	if rsp.Error != nil {
+		return nil, terrors.Wrap(rsp.Error, nil)
+	}
+	if rsp.Response == nil {
+		return nil, terrors.InternalService("doh_no_response", fmt.Sprintf("No response from DNS-over-HTTPS endpoint %s", endpoint), nil)
+	}
+
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, maxDNSMessageBytes+1))
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+	if len(body) > maxDNSMessageBytes {
+		return nil, terrors.BadResponse("malformed", fmt.Sprintf("DNS-over-HTTPS endpoint %s returned more than %d bytes", endpoint, maxDNSMessageBytes), nil)
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, terrors.BadResponse("doh_status", fmt.Sprintf("DNS-over-HTTPS endpoint %s returned status %d", endpoint, rsp.StatusCode), nil)
+	}
+
+	return body, nil
+}
+
+func buildDNSQuery(hostname string, recordType dnsmessage.Type) (uint16, []byte, error) {
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return 0, nil, terrors.Wrap(err, nil)
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+
+	if !strings.HasSuffix(hostname, ".") {
+		hostname = fmt.Sprintf("%s.", hostname)
+	}
+
+	name, err := dnsmessage.NewName(hostname)
+	if err != nil {
+		return 0, nil, terrors.Wrap(err, nil)
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	if err := builder.StartQuestions(); err != nil {
+		return 0, nil, terrors.Wrap(err, nil)
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: recordType, Class: dnsmessage.ClassINET}); err != nil {
+		return 0, nil, terrors.Wrap(err, nil)
+	}
+
+	query, err := builder.Finish()
+	if err != nil {
+		return 0, nil, terrors.Wrap(err, nil)
+	}
+
+	return id, query, nil
+}
+
+// parseDNSResponse extracts answers of the queried type from a response, also reporting
+// whether the response was truncated.
+func parseDNSResponse(id uint16, response []byte, recordType dnsmessage.Type) (*dnsAnswer, bool, error) {
+	parser := dnsmessage.Parser{}
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, false, terrors.BadResponse("malformed", err.Error(), nil)
+	}
+	if header.ID != id {
+		return nil, false, terrors.BadResponse("malformed", fmt.Sprintf("Response ID %d does not match query ID %d", header.ID, id), nil)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, false, terrors.BadResponse("malformed", err.Error(), nil)
+	}
+
+	answer := &dnsAnswer{
+		RCode:   header.RCode,
+		Answers: []string{},
+	}
+	for {
+		h, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, false, terrors.BadResponse("malformed", err.Error(), nil)
+		}
+
+		// Records of other types, such as the CNAMEs leading to an A record, are skipped
+		if h.Type != recordType || h.Class != dnsmessage.ClassINET {
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, false, terrors.BadResponse("malformed", err.Error(), nil)
+			}
+			continue
+		}
+
+		value, err := parseDNSAnswer(&parser, recordType)
+		if err != nil {
+			return nil, false, terrors.BadResponse("malformed", err.Error(), nil)
+		}
+
+		if len(answer.Answers) == 0 || h.TTL < answer.MinTTL {
+			answer.MinTTL = h.TTL
+		}
+		answer.Answers = append(answer.Answers, value)
+	}
+	sort.Strings(answer.Answers)
+
+	return answer, header.Truncated, nil
+}
+
+func parseDNSAnswer(parser *dnsmessage.Parser, recordType dnsmessage.Type) (string, error) {
+	switch recordType {
+	case dnsmessage.TypeA:
+		r, err := parser.AResource()
+		return net.IP(r.A[:]).String(), err
+	case dnsmessage.TypeAAAA:
+		r, err := parser.AAAAResource()
+		return net.IP(r.AAAA[:]).String(), err
+	case dnsmessage.TypeCNAME:
+		r, err := parser.CNAMEResource()
+		return normaliseDNSName(r.CNAME.String()), err
+	case dnsmessage.TypeMX:
+		r, err := parser.MXResource()
+		return fmt.Sprintf("%d %s", r.Pref, normaliseDNSName(r.MX.String())), err
+	case dnsmessage.TypeNS:
+		r, err := parser.NSResource()
+		return normaliseDNSName(r.NS.String()), err
+	case dnsmessage.TypeTXT:
+		r, err := parser.TXTResource()
+		return strings.Join(r.TXT, ""), err
+	default:
+		return "", parser.SkipAnswer()
+	}
+}
+
+// answersMatch compares sorted answers with expected answers in any order, after putting the
+// expected answers into the same form as answers parsed from responses.
+func answersMatch(answers, expected []string, recordType string) bool {
+	if len(answers) != len(expected) {
+		return false
+	}
+
+	normalised := make([]string, 0, len(expected))
+	for _, e := range expected {
+		switch recordType {
+		case "A", "AAAA":
+			if ip := net.ParseIP(e); ip != nil {
+				e = ip.String()
+			}
+		case "TXT":
+		default:
+			e = normaliseDNSName(e)
+		}
+		normalised = append(normalised, e)
+	}
+	sort.Strings(normalised)
+
+	for i := range answers {
+		if answers[i] != normalised[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func normaliseDNSName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func rcodeName(rcode dnsmessage.RCode) string {
+	if name, found := rcodeNames[rcode]; found {
+		return name
+	}
+
+	return fmt.Sprintf("%d", rcode)
+}
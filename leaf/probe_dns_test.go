@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// testDNSResponse describes the response a test resolver builds for a query.
+type testDNSResponse struct {
+	rcode     dnsmessage.RCode
+	truncated bool
+	wrongID   bool // Responds with an ID other than that of the query
+	cname     string
+	a         []string
+	ttls      []uint32
+}
+
+// build answers a query with the response described, which for a CNAME leads to the A
+// records given.
+func (r testDNSResponse) build(t *testing.T, query []byte) []byte {
+	parser := dnsmessage.Parser{}
+	header, err := parser.Start(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	question, err := parser.Question()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := header.ID
+	if r.wrongID {
+		id++
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: r.rcode, Truncated: r.truncated})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.Question(question); err != nil {
+		t.Fatal(err)
+	}
+	if err := builder.StartAnswers(); err != nil {
+		t.Fatal(err)
+	}
+
+	name := question.Name
+	if r.cname != "" {
+		target := dnsmessage.MustNewName(r.cname)
+		if err := builder.CNAMEResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: 30}, dnsmessage.CNAMEResource{CNAME: target}); err != nil {
+			t.Fatal(err)
+		}
+		name = target
+	}
+	for i, a := range r.a {
+		resource := dnsmessage.AResource{}
+		copy(resource.A[:], net.ParseIP(a).To4())
+		if err := builder.AResource(dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: r.ttls[i]}, resource); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	response, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return response
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	id, query, err := buildDNSQuery("example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		response  []byte
+		answer    *dnsAnswer
+		truncated bool
+		malformed bool
+	}{
+		{
+			name:     "answers sorted with the lowest ttl",
+			response: testDNSResponse{a: []string{"192.0.2.2", "192.0.2.1"}, ttls: []uint32{300, 60}}.build(t, query),
+			answer:   &dnsAnswer{RCode: dnsmessage.RCodeSuccess, Answers: []string{"192.0.2.1", "192.0.2.2"}, MinTTL: 60},
+		},
+		{
+			name:     "cname leading to the answers skipped",
+			response: testDNSResponse{cname: "target.example.com.", a: []string{"192.0.2.1"}, ttls: []uint32{120}}.build(t, query),
+			answer:   &dnsAnswer{RCode: dnsmessage.RCodeSuccess, Answers: []string{"192.0.2.1"}, MinTTL: 120},
+		},
+		{
+			name:     "nxdomain",
+			response: testDNSResponse{rcode: dnsmessage.RCodeNameError}.build(t, query),
+			answer:   &dnsAnswer{RCode: dnsmessage.RCodeNameError, Answers: []string{}},
+		},
+		{
+			name:      "truncated",
+			response:  testDNSResponse{truncated: true}.build(t, query),
+			answer:    &dnsAnswer{RCode: dnsmessage.RCodeSuccess, Answers: []string{}},
+			truncated: true,
+		},
+		{
+			name:      "response to another query",
+			response:  testDNSResponse{wrongID: true, a: []string{"192.0.2.1"}, ttls: []uint32{60}}.build(t, query),
+			malformed: true,
+		},
+		{
+			name:      "not a dns message",
+			response:  []byte("not dns"),
+			malformed: true,
+		},
+		{
+			name:      "cut short",
+			response:  testDNSResponse{a: []string{"192.0.2.1"}, ttls: []uint32{60}}.build(t, query)[:40],
+			malformed: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			answer, truncated, err := parseDNSResponse(id, c.response, dnsmessage.TypeA)
+			if c.malformed {
+				if !terrors.PrefixMatches(err, terrors.ErrBadResponse, "malformed") {
+					t.Errorf("expected a malformed response, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if truncated != c.truncated {
+				t.Errorf("expected truncated %v, got %v", c.truncated, truncated)
+			}
+			if answer.RCode != c.answer.RCode || answer.MinTTL != c.answer.MinTTL || strings.Join(answer.Answers, ",") != strings.Join(c.answer.Answers, ",") {
+				t.Errorf("expected %+v, got %+v", c.answer, answer)
+			}
+		})
+	}
+}
+
+func TestAnswersMatch(t *testing.T) {
+	cases := []struct {
+		answers    []string
+		expected   []string
+		recordType string
+		match      bool
+	}{
+		{[]string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.2", "192.0.2.1"}, "A", true},
+		{[]string{"192.0.2.1"}, []string{"192.0.2.1", "192.0.2.2"}, "A", false},
+		{[]string{"192.0.2.1"}, []string{"192.0.2.3"}, "A", false},
+		{[]string{"2001:db8::1"}, []string{"2001:0db8:0000::0001"}, "AAAA", true},
+		{[]string{"target.example.com"}, []string{"Target.Example.com."}, "CNAME", true},
+		{[]string{"10 mail.example.com"}, []string{"10 Mail.example.com."}, "MX", true},
+		{[]string{"v=spf1 -all"}, []string{"v=spf1 -all"}, "TXT", true},
+		{[]string{"v=spf1 -all"}, []string{"V=spf1 -all"}, "TXT", false},
+		{[]string{}, []string{}, "A", true},
+	}
+
+	for _, c := range cases {
+		if match := answersMatch(c.answers, c.expected, c.recordType); match != c.match {
+			t.Errorf("expected %s answers %v matching %v to be %v", c.recordType, c.answers, c.expected, c.match)
+		}
+	}
+}
+
+// serveTestDNS answers queries over UDP with a truncated response, and over TCP on the
+// same port in full, as a resolver would for a response too large for a datagram.
+func serveTestDNS(t *testing.T, response testDNSResponse) string {
+	udp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udp.Close() })
+	address := udp.LocalAddr().String()
+
+	tcp, err := net.Listen("tcp4", address)
+	if err != nil {
+		t.Skipf("cannot listen over TCP on the port of the UDP resolver: %v", err)
+	}
+	t.Cleanup(func() { tcp.Close() })
+
+	go func() {
+		buf := make([]byte, maxUDPResponseBytes)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// A stray datagram comes first, which the leaf must ignore
+			udp.WriteTo([]byte{0, 0, 0}, addr)
+			truncated := testDNSResponse{truncated: true}
+			udp.WriteTo(truncated.build(t, buf[:n]), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+
+			length := make([]byte, 2)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				conn.Close()
+				continue
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				conn.Close()
+				continue
+			}
+
+			full := response.build(t, query)
+			msg := make([]byte, 2+len(full))
+			binary.BigEndian.PutUint16(msg, uint16(len(full)))
+			copy(msg[2:], full)
+			conn.Write(msg)
+			conn.Close()
+		}
+	}()
+
+	return address
+}
+
+func TestDNSExchanges(t *testing.T) {
+	expected := testDNSResponse{a: []string{"192.0.2.1", "192.0.2.2"}, ttls: []uint32{60, 60}}
+	address := serveTestDNS(t, expected)
+
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			t.Errorf("unexpected DNS-over-HTTPS request %s %v", r.Method, r.Header)
+		}
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/dns-query":
+			w.Header().Set("Content-Type", "application/dns-message")
+			w.Write(expected.build(t, query))
+		case "/large":
+			w.Write(bytes.Repeat([]byte{0}, maxDNSMessageBytes+1))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer doh.Close()
+
+	p := &dnsProber{
+		clients: map[string]typhon.Service{
+			types.IPFamilyIPv4: typhon.HttpService(classifyingTransport{doh.Client().Transport}),
+		},
+	}
+
+	cases := []struct {
+		resolver string
+		failed   bool
+	}{
+		{"udp://" + address, false}, // Truncated over UDP, and retried over TCP
+		{"tcp://" + address, false},
+		{doh.URL + "/dns-query", false},
+		{doh.URL + "/large", true},
+		{doh.URL + "/missing", true},
+	}
+
+	for _, c := range cases {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		answer, err := p.query(ctx, c.resolver, "example.com", dnsmessage.TypeA, types.IPFamilyIPv4)
+		cancel()
+
+		if c.failed {
+			if err == nil {
+				t.Errorf("expected querying %s to fail, got %+v", c.resolver, answer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("error querying %s: %v", c.resolver, err)
+			continue
+		}
+		if answer.RCode != dnsmessage.RCodeSuccess || strings.Join(answer.Answers, ",") != "192.0.2.1,192.0.2.2" || answer.MinTTL != 60 {
+			t.Errorf("unexpected answer from %s: %+v", c.resolver, answer)
+		}
+	}
+}
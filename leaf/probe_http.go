@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// httpProber probes origins over HTTP(S), in either simple or advanced mode.
+type httpProber struct {
+	clients map[string]typhon.Service // By address family and protocol
+}
+
+// The transports are shared by origins with different timeouts, so probes are bounded by the
+// timeouts of their contexts instead.
+func newHTTPProber() *httpProber {
+	protocols := []string{types.HTTPProtocolAuto, types.HTTPProtocolHTTP1, types.HTTPProtocolH2, types.HTTPProtocolH2C, types.HTTPProtocolH3}
+
+	clients := map[string]typhon.Service{}
+	for _, family := range probeFamilies {
+		for _, protocol := range protocols {
+			// Do not reuse connections to get accurate full handshake times
+			clients[fmt.Sprintf("%s/%s", family, protocol)] = newProbeClient(newProbeTransport(family, protocol, false))
+		}
+	}
+
+	return &httpProber{
+		clients: clients,
+	}
+}
+
+// newProbeRequest builds the request sent to an origin, applying any customisations from its config.
+func newProbeRequest(ctx context.Context, origin types.OriginEntry) typhon.Request {
+	req := typhon.NewRequest(ctx, origin.Method, origin.URL, nil)
+	if origin.Body != "" {
+		req.Body = ioutil.NopCloser(strings.NewReader(origin.Body))
+		req.ContentLength = int64(len(origin.Body))
+	}
+
+	for header, value := range origin.Headers {
+		req.Header.Set(header, value)
+	}
+
+	if origin.HostHeader != "" {
+		req.Host = origin.HostHeader
+	}
+
+	return req
+}
+
+func (p *httpProber) probe(ctx context.Context, origin types.OriginEntry, labels probeLabels) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout(origin))
+	defer cancel()
+
+	trace := newProbeTrace()
+	traceCtx := trace.withContext(withProxy(withPinnedAddress(ctx, labels.TargetIP), originProxy(origin)))
+
+	client := p.clients[fmt.Sprintf("%s/%s", labels.IPFamily, origin.Protocol)]
+	var warm *warmConnection
+	if labels.Connection == types.ConnectionModeWarm {
+		warm = warmConnections.get(labels, origin.Protocol)
+		client = warm.client
+	}
+
+	// Advanced origins echo the nonce back, so that a response cached from an earlier
+	// request can be told apart from one to this request.
+	req := newProbeRequest(traceCtx, origin)
+	nonce := ""
+	start := time.Now()
+	if origin.Mode == types.OriginModeAdvanced {
+		nonce = newNonce()
+		identifyProbe(&req, nonce, start.UnixNano())
+	}
+
+	r := req.SendVia(client).Response()
+	if warm != nil {
+		reconnected := warm.reconnected(trace.newConnection())
+		if reconnected {
+			slog.Debug(ctx, "Re-established warm connection to %s", origin.URL)
+		}
+		registerWarmProbe(labels, reconnected)
+	}
+	registerHappyEyeballsWinner(labels, origin, trace)
+	if inspection, ok := trace.tlsInspection(origin.Hostname); ok {
+		registerTLSInspection(labels, inspection)
+	}
+
+	// Without a response there is no status code to report
+	if r.Error != nil || r.Response == nil {
+		registerProbeResult(labels, false, trace.failureReason(ctx, r.Error))
+		slog.Error(ctx, "Error received from %s %s:%d: %v", origin.Scheme, origin.Hostname, origin.Port, r.Error)
+		return r.Error
+	}
+	end := time.Now()
+	duration := end.Sub(start)
+	protocol := negotiatedProtocol(r.Response)
+
+	// Read the full body even in simple mode, so that we can time its transfer.
+	rBytes, tooLarge, err := readResponseBody(r, origin.Assertions.MaxBodyBytes)
+	if err != nil {
+		registerProbeStatus(labels, false, trace.failureReason(ctx, err), r.StatusCode)
+		slog.Error(ctx, "Error reading response from %s %s:%d: %v", origin.Scheme, origin.Hostname, origin.Port, err)
+		return err
+	}
+	bodyDone := time.Now()
+
+	if tooLarge {
+		registerProbeStatus(labels, false, reasonBodyTooLarge, r.StatusCode)
+		err = terrors.BadResponse(reasonBodyTooLarge, fmt.Sprintf("Response from origin %s exceeded %d bytes", labels.OriginID, origin.Assertions.MaxBodyBytes), nil)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	// Origins which do not support HTTP/2 over TLS fall back to HTTP/1.1 during the handshake
+	if origin.Protocol == types.HTTPProtocolH2 && protocol != negotiatedH2 {
+		registerProbeStatus(labels, false, reasonProtocolMismatch, r.StatusCode)
+		err = terrors.BadResponse(reasonProtocolMismatch, fmt.Sprintf("Origin %s responded over %s rather than %s", labels.OriginID, protocol, negotiatedH2), nil)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	if ok, reason := checkAssertions(origin.Assertions, r.StatusCode, rBytes); !ok {
+		if isStaleProbe(r.StatusCode, r.Header, rBytes) {
+			reason = reasonClockSkew
+		}
+		registerProbeStatus(labels, false, reason, r.StatusCode)
+		err = terrors.BadResponse(reason, fmt.Sprintf("Response from origin %s failed assertions with status %d", labels.OriginID, r.StatusCode), nil)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	inspection := inspectCacheHeaders(r.Header)
+
+	// No metrics will be available from simple origin, we only check the response is as expected.
+	if origin.Mode == types.OriginModeSimple {
+		registerCacheInspection(labels, inspection, false)
+		registerProbeSuccess(labels, r.StatusCode, protocol, duration, trace.phases(bodyDone))
+		return nil
+	}
+
+	rsp := &types.OriginResponse{}
+	err = json.Unmarshal(rBytes, rsp)
+	if err != nil {
+		registerProbeStatus(labels, false, reasonMalformedResponse, r.StatusCode)
+		slog.Error(ctx, "Error parsing response from %s %s:%d: %v", origin.Scheme, origin.Hostname, origin.Port, err)
+		return err
+	}
+
+	// Anything which is not the origin, such as a captive portal, cannot sign its responses
+	if verifier := originVerifier(origin); verifier != nil && !verifier.Verify(rsp.SigningMessage(), rsp.Signature) {
+		err = terrors.BadResponse(reasonSignatureInvalid, fmt.Sprintf("Response from origin %s is not signed with its key", labels.OriginID), nil)
+		registerProbeStatus(labels, false, reasonSignatureInvalid, r.StatusCode)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	// Origins which predate nonces do not echo them, and are only checked for repeated tokens.
+	if rsp.Nonce != "" && rsp.Nonce != nonce {
+		err = terrors.BadResponse(reasonStaleNonce, fmt.Sprintf("Received nonce %s from origin %s in response to %s at %s", rsp.Nonce, labels.OriginID, nonce, rsp.ServerTime), nil)
+		registerStaleResponse(labels, staleCheckNonce, inspection)
+		registerProbeStatus(labels, false, reasonStaleNonce, r.StatusCode)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	// A true server response carries a token which is unique to it, so a token received before
+	// means a bad cache somewhere between the leaf and the origin.
+	if originTokens.repeated(labels, rsp.Token) {
+		err = terrors.BadResponse(reasonStaleToken, fmt.Sprintf("Received repeated token from origin %s: %s at %s", labels.OriginID, rsp.Token, rsp.ServerTime), nil)
+		registerStaleResponse(labels, staleCheckToken, inspection)
+		registerProbeStatus(labels, false, reasonStaleToken, r.StatusCode)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	serverTime, err := time.Parse(time.RFC3339, rsp.ServerTime)
+	if err != nil {
+		registerProbeStatus(labels, false, reasonMalformedResponse, r.StatusCode)
+		slog.Error(ctx, "Unexpected error parsing response server time %s from %s %s:%d: %v", rsp.ServerTime, origin.Scheme, origin.Hostname, origin.Port, err)
+		return err
+	}
+
+	// Success
+	registerCacheInspection(labels, inspection, false)
+	registerProbeSuccess(labels, r.StatusCode, protocol, duration, trace.phases(bodyDone))
+
+	// The time sent to the origin only identifies the exchange its timestamps belong to, as
+	// connecting comes between it and the request being sent.
+	if sent, arrived, ok := trace.exchangeTimes(); ok {
+		if sample, ok := originClockSample(rsp, start.UnixNano(), sent, arrived); ok {
+			registerOriginClock(labels, originClocks.add(labels, sample))
+			return nil
+		}
+	}
+
+	// Origins which predate timestamps only give the time to the second, which is compared
+	// with the middle of the probe as the best estimate available.
+	estimatedDrift := serverTime.Sub(start.Add(duration / 2))
+	registerOriginTimeDrift(labels, estimatedDrift.Seconds())
+
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// IANA protocol numbers, as expected by icmp.ParseMessage
+const (
+	protocolICMP   = 1
+	protocolICMPv6 = 58
+)
+
+// icmpProber probes origins with bursts of ICMP echo requests, like ping, measuring loss,
+// round trip times and the TTL of replies.
+type icmpProber struct{}
+
+func newICMPProber() *icmpProber {
+	return &icmpProber{}
+}
+
+func (p *icmpProber) probe(ctx context.Context, origin types.OriginEntry, labels probeLabels) error {
+	ip, err := resolveProbeTarget(ctx, probeHost(origin, labels), labels.IPFamily)
+	if err != nil {
+		registerProbeResult(labels, false, classifyError(err))
+		slog.Error(ctx, "Error resolving %s: %v", origin.URL, err)
+		return err
+	}
+
+	v6 := ip.To4() == nil
+	conn, err := newICMPConn(ctx, v6, origin.DontFragment)
+	if err != nil {
+		registerProbeResult(labels, false, reasonSocket)
+		slog.Error(ctx, "Error opening ICMP socket for %s: %v", origin.URL, err)
+		return err
+	}
+	defer conn.Close()
+
+	// Replies are matched to this burst by a random session ID at the start of the data. On
+	// raw sockets, which receive all ICMP traffic of the host, the identifier is also checked.
+	session := make([]byte, 10)
+	if _, err := rand.Read(session); err != nil {
+		return terrors.Wrap(err, nil)
+	}
+	id := int(binary.BigEndian.Uint16(session[8:]))
+	session = session[:8]
+
+	interval := time.Duration(origin.PacketIntervalMs) * time.Millisecond
+	wait := maxUDPReplyWait
+	if timeout := probeTimeout(origin); timeout < wait {
+		wait = timeout
+	}
+	conn.SetReadDeadline(burstDeadline(ctx, origin.Count, interval, wait))
+
+	replies := make(chan burstReply, origin.Count*4)
+	go conn.readReplies(id, session, origin.Count, replies)
+
+	dst := icmpDestination(ip, conn.raw)
+	sendTimes := []time.Time{}
+	data := make([]byte, origin.PacketSize)
+	copy(data, session)
+	err = sendBurst(ctx, origin.Count, interval, func(seq int) error {
+		packet, err := echoRequest(v6, id, seq, data)
+		if err != nil {
+			return terrors.Wrap(err, nil)
+		}
+
+		sendTimes = append(sendTimes, time.Now())
+		if _, err := conn.WriteTo(packet, dst); err != nil {
+			slog.Warn(ctx, "Error sending echo request %d to %s: %v", seq, origin.URL, err)
+		}
+		return nil
+	})
+	if err != nil {
+		// Replies to echo requests already sent are not waited for
+		conn.Close()
+		for range replies {
+		}
+		if err != context.Canceled {
+			registerProbeResult(labels, false, classifyError(err))
+			slog.Error(ctx, "Burst to %s cut short after %d echo requests: %v", origin.URL, len(sendTimes), err)
+		}
+		return err
+	}
+
+	received := []burstReply{}
+	unique := map[uint32]bool{}
+	for reply := range replies {
+		received = append(received, reply)
+		unique[reply.Seq] = true
+
+		// Stop the reader early once every echo request has been answered
+		if len(unique) == origin.Count {
+			conn.Close()
+		}
+	}
+
+	result := summariseBurst(sendTimes, received)
+	registerICMPBurst(labels, result)
+
+	if result.Received == 0 {
+		err = terrors.Timeout(reasonNoReplies, fmt.Sprintf("No replies received from %s to %d echo requests", origin.URL, result.Sent), nil)
+		registerProbeResult(labels, false, reasonNoReplies)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	registerProbeSuccess(labels, 0, "", result.RTTAvg, probePhases{})
+
+	return nil
+}
+
+// icmpConn is an ICMP socket from which the TTL or hop limit of replies can be read.
+type icmpConn struct {
+	net.PacketConn
+	v4  *ipv4.PacketConn
+	v6  *ipv6.PacketConn
+	raw bool
+}
+
+func newICMPConn(ctx context.Context, v6, dontFragment bool) (*icmpConn, error) {
+	conn, raw, err := listenICMP(ctx, v6, dontFragment)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &icmpConn{
+		PacketConn: conn,
+		raw:        raw,
+	}
+
+	// Failing to read the TTL of replies is not worth failing the probe over
+	if v6 {
+		c.v6 = ipv6.NewPacketConn(conn)
+		c.v6.SetControlMessage(ipv6.FlagHopLimit, true)
+	} else {
+		c.v4 = ipv4.NewPacketConn(conn)
+		c.v4.SetControlMessage(ipv4.FlagTTL, true)
+	}
+
+	return c, nil
+}
+
+// icmpDestination returns the address to send to, which for unprivileged datagram sockets
+// must be a UDP address.
+func icmpDestination(ip net.IP, raw bool) net.Addr {
+	if raw {
+		return &net.IPAddr{IP: ip}
+	}
+
+	return &net.UDPAddr{IP: ip}
+}
+
+// echoRequest builds an echo request. The kernel calculates the checksum of ICMPv6 messages,
+// and replaces the identifier with its own on unprivileged sockets.
+func echoRequest(v6 bool, id, seq int, data []byte) ([]byte, error) {
+	var messageType icmp.Type = ipv4.ICMPTypeEcho
+	if v6 {
+		messageType = ipv6.ICMPTypeEchoRequest
+	}
+
+	message := icmp.Message{
+		Type: messageType,
+		Body: &icmp.Echo{
+			ID:   id,
+			Seq:  seq,
+			Data: data,
+		},
+	}
+
+	return message.Marshal(nil)
+}
+
+func (c *icmpConn) readFrom(buf []byte) (int, int, error) {
+	if c.v6 != nil {
+		n, cm, _, err := c.v6.ReadFrom(buf)
+		if err != nil || cm == nil {
+			return n, 0, err
+		}
+		return n, cm.HopLimit, nil
+	}
+
+	n, cm, _, err := c.v4.ReadFrom(buf)
+	if err != nil || cm == nil {
+		return n, 0, err
+	}
+	return n, cm.TTL, nil
+}
+
+// readReplies reads echo replies belonging to the session until the connection is closed
+// or its deadline passes, then closes the channel.
+func (c *icmpConn) readReplies(id int, session []byte, count int, replies chan<- burstReply) {
+	defer close(replies)
+
+	protocol := protocolICMP
+	var replyType icmp.Type = ipv4.ICMPTypeEchoReply
+	if c.v6 != nil {
+		protocol = protocolICMPv6
+		replyType = ipv6.ICMPTypeEchoReply
+	}
+
+	buf := make([]byte, types.EchoMaxPacketSize)
+	for {
+		n, ttl, err := c.readFrom(buf)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+
+		message, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil || message.Type != replyType {
+			continue
+		}
+
+		echo, ok := message.Body.(*icmp.Echo)
+		if !ok || (c.raw && echo.ID != id) || !bytes.HasPrefix(echo.Data, session) {
+			continue
+		}
+
+		if echo.Seq < 0 || echo.Seq >= count {
+			continue
+		}
+
+		select {
+		case replies <- burstReply{Seq: uint32(echo.Seq), Received: received, TTL: ttl}:
+		default:
+			// Only possible with a flood of duplicates, which are not worth blocking for
+		}
+	}
+}
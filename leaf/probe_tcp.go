@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// We will not read more than this much while waiting for an expected banner
+const maxBannerBytes = 4096
+
+// tcpProber probes origins by establishing a TCP connection, timing the handshake.
+type tcpProber struct{}
+
+func newTCPProber() *tcpProber {
+	return &tcpProber{}
+}
+
+func (p *tcpProber) probe(ctx context.Context, origin types.OriginEntry, labels probeLabels) error {
+	// Handshakes with proxies are bounded by the probe timeout along with the connection
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout(origin))
+	defer cancel()
+
+	// The dialer reports DNS, connect and proxy phases through the same hooks as HTTP probes
+	trace := newProbeTrace()
+	traceCtx := trace.withContext(withProxy(ctx, originProxy(origin)))
+
+	dialer := &net.Dialer{
+		Timeout:   probeTimeout(origin),
+		KeepAlive: -1 * time.Second, // Disabled
+		DualStack: true,
+	}
+
+	start := time.Now()
+	conn, err := familyDialContext(dialer, labels.IPFamily)(traceCtx, "tcp", net.JoinHostPort(probeHost(origin, labels), strconv.Itoa(origin.Port)))
+	if err != nil {
+		registerProbeResult(labels, false, trace.failureReason(traceCtx, err))
+		slog.Error(ctx, "Error connecting to %s: %v", origin.URL, err)
+		return err
+	}
+	defer conn.Close()
+	duration := time.Since(start)
+	registerHappyEyeballsWinner(labels, origin, trace)
+
+	if origin.Expect != "" || origin.Send != "" {
+		if err := conn.SetDeadline(start.Add(probeTimeout(origin))); err != nil {
+			registerProbeResult(labels, false, classifyError(err))
+			return err
+		}
+	}
+
+	if origin.Send != "" {
+		if _, err := conn.Write([]byte(origin.Send)); err != nil {
+			registerProbeResult(labels, false, classifyError(err))
+			slog.Error(ctx, "Error sending payload to %s: %v", origin.URL, err)
+			return err
+		}
+	}
+
+	if origin.Expect != "" {
+		banner, err := readBanner(conn, []byte(origin.Expect))
+		if err != nil {
+			registerProbeResult(labels, false, classifyError(err))
+			slog.Error(ctx, "Error reading banner from %s: %v", origin.URL, err)
+			return err
+		}
+
+		if !bytes.Contains(banner, []byte(origin.Expect)) {
+			registerProbeResult(labels, false, reasonBannerMismatch)
+			err = terrors.BadResponse(reasonBannerMismatch, fmt.Sprintf("Banner from origin %s did not contain %q", labels.OriginID, origin.Expect), nil)
+			slog.Error(ctx, "%+v", err)
+			return err
+		}
+	}
+
+	registerProbeSuccess(labels, 0, "", duration, trace.phases(time.Time{}))
+
+	return nil
+}
+
+// readBanner reads from the connection until the expected string is seen, the origin
+// closes the connection, or we have read as much as we are willing to.
+func readBanner(conn net.Conn, expect []byte) ([]byte, error) {
+	banner := make([]byte, 0, maxBannerBytes)
+	buf := make([]byte, maxBannerBytes)
+	for len(banner) < maxBannerBytes {
+		n, err := conn.Read(buf[:maxBannerBytes-len(banner)])
+		banner = append(banner, buf[:n]...)
+		if bytes.Contains(banner, expect) {
+			return banner, nil
+		}
+		if err != nil {
+			// The origin closing the connection after a complete banner is not an error
+			if len(banner) > 0 {
+				return banner, nil
+			}
+			return nil, err
+		}
+	}
+
+	return banner, nil
+}
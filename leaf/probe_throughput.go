@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// Transfers are run one at a time on each leaf, so that transfers to different origins do
+// not compete for the bandwidth of the leaf.
+var throughputMu sync.Mutex
+
+// throughputResult is the outcome of a transfer in one direction.
+type throughputResult struct {
+	Direction string
+	Bytes     int64
+	Duration  time.Duration // From sending the request to the transfer completing
+	Transfer  time.Duration // From the first byte of the payload to the last
+}
+
+// throughputProber measures the bandwidth between leaves and origins by downloading from and
+// uploading to the throughput endpoints of an Oxcross origin server. Each transfer is made
+// over a new connection, so that it starts from the beginning of TCP slow start as a
+// client's would.
+type throughputProber struct {
+	clients map[string]typhon.Service // By address family
+}
+
+func newThroughputProber() *throughputProber {
+	clients := map[string]typhon.Service{}
+	for _, family := range probeFamilies {
+		clients[family] = newProbeClient(newProbeTransport(family, types.HTTPProtocolHTTP1, false))
+	}
+
+	return &throughputProber{
+		clients: clients,
+	}
+}
+
+func (p *throughputProber) probe(ctx context.Context, origin types.OriginEntry, labels probeLabels) error {
+	throughputMu.Lock()
+	defer throughputMu.Unlock()
+
+	directions := []string{origin.Direction}
+	if origin.Direction == types.ThroughputDirectionBoth {
+		directions = []string{types.ThroughputDirectionDownload, types.ThroughputDirectionUpload}
+	}
+
+	for _, direction := range directions {
+		var result throughputResult
+		var statusCode int
+		var reason string
+		var err error
+		if direction == types.ThroughputDirectionDownload {
+			result, statusCode, reason, err = p.download(ctx, origin, labels)
+		} else {
+			result, statusCode, reason, err = p.upload(ctx, origin, labels)
+		}
+		if err != nil {
+			registerProbeStatus(labels, false, reason, statusCode)
+			slog.Error(ctx, "Error measuring %s throughput of %s: %v", direction, origin.URL, err)
+			return err
+		}
+
+		registerThroughput(labels, result)
+	}
+
+	registerProbeStatus(labels, true, "", http.StatusOK)
+
+	return nil
+}
+
+// download fetches the number of bytes configured from the origin, timing the transfer from
+// the first byte of the response to the last.
+func (p *throughputProber) download(ctx context.Context, origin types.OriginEntry, labels probeLabels) (throughputResult, int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout(origin))
+	defer cancel()
+
+	trace := newProbeTrace()
+	traceCtx := trace.withContext(withProxy(withPinnedAddress(ctx, labels.TargetIP), originProxy(origin)))
+
+	url := fmt.Sprintf("%s%s?bytes=%d", origin.URL, types.ThroughputDownloadPath, origin.DownloadBytes)
+	start := time.Now()
+	req := typhon.NewRequest(traceCtx, http.MethodGet, url, nil)
+	identifyProbe(&req, newNonce(), start.UnixNano())
+	r := req.SendVia(p.clients[labels.IPFamily]).Response()
+	if r.Error != nil || r.Response == nil {
+		return throughputResult{}, 0, trace.failureReason(ctx, r.Error), r.Error
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		reason := statusReason(r.StatusCode)
+		return throughputResult{}, r.StatusCode, reason, terrors.BadResponse(reason, fmt.Sprintf("Origin %s responded with status %d to a download", labels.OriginID, r.StatusCode), nil)
+	}
+
+	n, err := io.Copy(ioutil.Discard, r.Body)
+	if err != nil {
+		return throughputResult{}, r.StatusCode, trace.failureReason(ctx, err), err
+	}
+	end := time.Now()
+
+	if n != origin.DownloadBytes {
+		return throughputResult{}, r.StatusCode, reasonTransferIncomplete, terrors.BadResponse(reasonTransferIncomplete, fmt.Sprintf("Downloaded %d bytes from origin %s rather than %d", n, labels.OriginID, origin.DownloadBytes), nil)
+	}
+
+	return throughputResult{
+		Direction: types.ThroughputDirectionDownload,
+		Bytes:     n,
+		Duration:  end.Sub(start),
+		Transfer:  trace.phases(end).Transfer,
+	}, r.StatusCode, "", nil
+}
+
+// upload sends the number of bytes configured to the origin. The transfer is timed by the
+// origin from the first byte it receives to the last, as bytes written by the leaf may still
+// be buffered on their way.
+func (p *throughputProber) upload(ctx context.Context, origin types.OriginEntry, labels probeLabels) (throughputResult, int, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout(origin))
+	defer cancel()
+
+	trace := newProbeTrace()
+	traceCtx := trace.withContext(withProxy(withPinnedAddress(ctx, labels.TargetIP), originProxy(origin)))
+
+	// Random bytes cannot be compressed by anything along the way
+	payload := io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), origin.UploadBytes)
+	req := typhon.NewRequest(traceCtx, http.MethodPost, origin.URL+types.ThroughputUploadPath, nil)
+	req.Body = ioutil.NopCloser(payload)
+	req.ContentLength = origin.UploadBytes
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	identifyProbe(&req, newNonce(), start.UnixNano())
+	r := req.SendVia(p.clients[labels.IPFamily]).Response()
+	if r.Error != nil || r.Response == nil {
+		return throughputResult{}, 0, trace.failureReason(ctx, r.Error), r.Error
+	}
+	end := time.Now()
+
+	if r.StatusCode != http.StatusOK {
+		r.Body.Close()
+		reason := statusReason(r.StatusCode)
+		return throughputResult{}, r.StatusCode, reason, terrors.BadResponse(reason, fmt.Sprintf("Origin %s responded with status %d to an upload", labels.OriginID, r.StatusCode), nil)
+	}
+
+	body, err := r.BodyBytes(true)
+	if err != nil {
+		return throughputResult{}, r.StatusCode, trace.failureReason(ctx, err), err
+	}
+
+	rsp := &types.ThroughputUploadResponse{}
+	if err := json.Unmarshal(body, rsp); err != nil {
+		return throughputResult{}, r.StatusCode, reasonMalformedResponse, terrors.Wrap(err, nil)
+	}
+
+	if rsp.Bytes != origin.UploadBytes {
+		return throughputResult{}, r.StatusCode, reasonTransferIncomplete, terrors.BadResponse(reasonTransferIncomplete, fmt.Sprintf("Origin %s received %d uploaded bytes rather than %d", labels.OriginID, rsp.Bytes, origin.UploadBytes), nil)
+	}
+
+	return throughputResult{
+		Direction: types.ThroughputDirectionUpload,
+		Bytes:     rsp.Bytes,
+		Duration:  end.Sub(start),
+		Transfer:  time.Duration(rsp.Duration * float64(time.Second)),
+	}, r.StatusCode, "", nil
+}
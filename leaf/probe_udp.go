@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// We stop waiting for late replies this long after the last packet of a burst is sent,
+// or after the probe timeout if that is shorter.
+const maxUDPReplyWait = 2 * time.Second
+
+// udpProber probes the UDP echo responder of an origin with bursts of sequence-numbered
+// packets, and measures loss, reordering, duplication, round trip times and jitter.
+type udpProber struct{}
+
+func newUDPProber() *udpProber {
+	return &udpProber{}
+}
+
+func (p *udpProber) probe(ctx context.Context, origin types.OriginEntry, labels probeLabels) error {
+	dialer := &net.Dialer{
+		Timeout:   probeTimeout(origin),
+		DualStack: true,
+	}
+
+	conn, err := sourceDialer(ctx, dialer, "udp").DialContext(ctx, familyNetwork("udp", labels.IPFamily), net.JoinHostPort(probeHost(origin, labels), strconv.Itoa(origin.Port)))
+	if err != nil {
+		registerProbeResult(labels, false, classifyError(err))
+		slog.Error(ctx, "Error connecting to %s: %v", origin.URL, err)
+		return err
+	}
+	defer conn.Close()
+
+	// Replies are matched to this burst by a random session ID
+	session := make([]byte, 8)
+	if _, err := rand.Read(session); err != nil {
+		return terrors.Wrap(err, nil)
+	}
+
+	interval := time.Duration(origin.PacketIntervalMs) * time.Millisecond
+	wait := maxUDPReplyWait
+	if timeout := probeTimeout(origin); timeout < wait {
+		wait = timeout
+	}
+	conn.SetReadDeadline(burstDeadline(ctx, origin.Count, interval, wait))
+
+	replies := make(chan burstReply, origin.Count*4)
+	go readUDPReplies(conn, session, origin.Count, replies)
+
+	start := time.Now()
+	sendTimes := []time.Time{}
+	packet := make([]byte, origin.PacketSize)
+	copy(packet, types.EchoMagic)
+	copy(packet[4:12], session)
+	err = sendBurst(ctx, origin.Count, interval, func(seq int) error {
+		binary.BigEndian.PutUint32(packet[12:16], uint32(seq))
+		sendTimes = append(sendTimes, time.Now())
+		binary.BigEndian.PutUint64(packet[16:24], uint64(sendTimes[seq].Sub(start)))
+		if _, err := conn.Write(packet); err != nil {
+			slog.Warn(ctx, "Error sending packet %d to %s: %v", seq, origin.URL, err)
+		}
+		return nil
+	})
+	if err != nil {
+		// Replies to packets already sent are not waited for
+		conn.Close()
+		for range replies {
+		}
+		if err != context.Canceled {
+			registerProbeResult(labels, false, classifyError(err))
+			slog.Error(ctx, "Burst to %s cut short after %d packets: %v", origin.URL, len(sendTimes), err)
+		}
+		return err
+	}
+
+	received := []burstReply{}
+	unique := map[uint32]bool{}
+	for reply := range replies {
+		received = append(received, reply)
+		unique[reply.Seq] = true
+
+		// Stop the reader early once every packet has come back
+		if len(unique) == origin.Count {
+			conn.Close()
+		}
+	}
+
+	result := summariseBurst(sendTimes, received)
+	registerUDPBurst(labels, result)
+
+	if result.Received == 0 {
+		err = terrors.Timeout(reasonNoReplies, fmt.Sprintf("No replies received from %s to %d packets", origin.URL, result.Sent), nil)
+		registerProbeResult(labels, false, reasonNoReplies)
+		slog.Error(ctx, "%+v", err)
+		return err
+	}
+
+	registerProbeSuccess(labels, 0, "", result.RTTAvg, probePhases{})
+
+	return nil
+}
+
+// readUDPReplies reads replies belonging to the session until the connection is closed or
+// its deadline passes, then closes the channel.
+func readUDPReplies(conn net.Conn, session []byte, count int, replies chan<- burstReply) {
+	defer close(replies)
+
+	buf := make([]byte, types.EchoMaxPacketSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+
+		if n < types.EchoHeaderSize || !bytes.HasPrefix(buf, []byte(types.EchoMagic)) || !bytes.Equal(buf[4:12], session) {
+			continue
+		}
+
+		seq := binary.BigEndian.Uint32(buf[12:16])
+		if int(seq) >= count {
+			continue
+		}
+
+		select {
+		case replies <- burstReply{Seq: seq, Received: received}:
+		default:
+			// Only possible with a flood of duplicates, which are not worth blocking for
+		}
+	}
+}
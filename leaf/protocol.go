@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// Protocols negotiated with origins, as recorded in the protocol label of timings
+const (
+	negotiatedHTTP1 = "http/1.1"
+	negotiatedH2    = "h2"
+	negotiatedH2C   = "h2c"
+	negotiatedH3    = "h3"
+)
+
+// probeTransport is a transport for probes of a particular protocol, which can close the
+// connections it keeps open.
+type probeTransport interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
+
+// newProbeTransport creates a transport sending requests with the given protocol over the
+// given family. Transports which keep connections alive keep a single connection open.
+func newProbeTransport(family, protocol string, keepAlive bool) probeTransport {
+	dialer := &net.Dialer{
+		KeepAlive: -1 * time.Second, // Disabled
+		DualStack: true,
+	}
+
+	switch protocol {
+	case types.HTTPProtocolH2C:
+		return &h2cTransport{
+			transport: &http2.Transport{AllowHTTP: true},
+			dial:      familyDialContext(dialer, family),
+			keepAlive: keepAlive,
+		}
+	case types.HTTPProtocolH3:
+		return &h3Transport{
+			transport: &http3.Transport{},
+			family:    family,
+			keepAlive: keepAlive,
+		}
+	}
+
+	transport := &http.Transport{
+		DisableKeepAlives:     !keepAlive,
+		DialContext:           familyDialContext(dialer, family),
+		MaxIdleConns:          1,
+		MaxIdleConnsPerHost:   1,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	// HTTP/2 is negotiated through ALPN where the origin supports it, and otherwise the
+	// transport falls back to HTTP/1.1, which fails probes requiring HTTP/2.
+	switch protocol {
+	case types.HTTPProtocolAuto, types.HTTPProtocolH2:
+		transport.ForceAttemptHTTP2 = true
+	default:
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return transport
+}
+
+// newProbeClient creates a client for probes of a particular protocol. Error responses are
+// not turned into errors, as origins decide which status codes are acceptable.
+func newProbeClient(transport probeTransport) typhon.Service {
+	return typhon.HttpService(classifyingTransport{transport}).Filter(typhon.ExpirationFilter).Filter(typhon.H2cFilter)
+}
+
+// negotiatedProtocol returns the protocol a response was received over.
+func negotiatedProtocol(rsp *http.Response) string {
+	switch {
+	case rsp.ProtoMajor == 3:
+		return negotiatedH3
+	case rsp.ProtoMajor == 2 && rsp.TLS != nil:
+		return negotiatedH2
+	case rsp.ProtoMajor == 2:
+		return negotiatedH2C
+	default:
+		return negotiatedHTTP1
+	}
+}
+
+// h2cTransport sends requests over HTTP/2 without TLS, with prior knowledge that the origin
+// supports it. Unlike with http2.Transport, connections are dialled with the context of
+// each request, so that they are traced and pinned to an address like those of other
+// protocols. Without keep alive, each connection is closed along with its response body.
+type h2cTransport struct {
+	transport *http2.Transport
+	dial      func(ctx context.Context, network, address string) (net.Conn, error)
+	keepAlive bool
+
+	mu   sync.Mutex
+	conn *http2.ClientConn
+}
+
+func (t *h2cTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, reused, err := t.clientConn(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Reused: reused})
+	}
+
+	rsp, err := conn.RoundTrip(req)
+	if t.keepAlive {
+		return rsp, err
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	rsp.Body = &connClosingBody{ReadCloser: rsp.Body, conn: conn}
+	return rsp, nil
+}
+
+// clientConn returns the connection to send a request over, and whether it was reused.
+func (t *h2cTransport) clientConn(req *http.Request) (*http2.ClientConn, bool, error) {
+	// Only the connection kept alive is shared between requests
+	if t.keepAlive {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.conn != nil && t.conn.CanTakeNewRequest() {
+			return t.conn, true, nil
+		}
+	}
+
+	address := req.URL.Host
+	if req.URL.Port() == "" {
+		address = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+
+	netConn, err := t.dial(req.Context(), "tcp", address)
+	if err != nil {
+		return nil, false, err
+	}
+
+	conn, err := t.transport.NewClientConn(netConn)
+	if err != nil {
+		netConn.Close()
+		return nil, false, err
+	}
+
+	if t.keepAlive {
+		t.conn = conn
+	}
+
+	return conn, false, nil
+}
+
+func (t *h2cTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// Connections over HTTP/3 kept alive send a keep alive this often while idle
+const h3KeepAlivePeriod = 15 * time.Second
+
+// h3Transport sends requests over HTTP/3, to origins listening for QUIC on the port of their
+// URL. Connections are dialled from a socket of their own bound to the source of the probe,
+// to any address pinned in the context, and traced like those of other protocols. QUIC
+// establishes the connection and its TLS session in the same handshake, which is timed as
+// the TLS phase. Without keep alive, each connection is closed along with its response body.
+type h3Transport struct {
+	transport *http3.Transport
+	family    string
+	keepAlive bool
+
+	mu   sync.Mutex
+	conn *h3Conn
+}
+
+// h3Conn is an HTTP/3 connection, along with the socket it was dialled from.
+type h3Conn struct {
+	*http3.ClientConn
+	quic   *quic.Conn
+	socket net.PacketConn
+}
+
+func (c *h3Conn) Close() error {
+	c.quic.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "")
+	return c.socket.Close()
+}
+
+func (t *h3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, reused, err := t.clientConn(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Reused: reused})
+	}
+
+	rsp, err := conn.RoundTrip(req)
+	if t.keepAlive {
+		return rsp, err
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	rsp.Body = &connClosingBody{ReadCloser: rsp.Body, conn: conn}
+	return rsp, nil
+}
+
+// clientConn returns the connection to send a request over, and whether it was reused.
+func (t *h3Transport) clientConn(req *http.Request) (*h3Conn, bool, error) {
+	// Only the connection kept alive is shared between requests
+	if t.keepAlive {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if t.conn != nil && t.conn.quic.Context().Err() == nil {
+			return t.conn, true, nil
+		}
+	}
+
+	conn, err := t.dial(req.Context(), req.URL)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if t.keepAlive {
+		t.conn = conn
+	}
+
+	return conn, false, nil
+}
+
+// dial resolves the host of a URL over the family of the transport, unless an address is
+// pinned in the context, and establishes a QUIC connection to it. QUIC cannot be tunnelled
+// through the proxies supported, so probes of leaves with a proxy fail rather than silently
+// bypassing it.
+func (t *h3Transport) dial(ctx context.Context, u *url.URL) (*h3Conn, error) {
+	if ctx.Value(proxyKey{}) != nil {
+		return nil, terrors.PreconditionFailed(reasonProxyUnsupported, fmt.Sprintf("Cannot send HTTP/3 to %s through a proxy", u.Host), map[string]string{
+			"reason": reasonProxyUnsupported,
+		})
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	host := pinAddress(ctx, net.JoinHostPort(u.Hostname(), port))
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := net.ParseIP(hostname)
+	if ip == nil {
+		ip, err = resolveProbeTarget(ctx, hostname, t.family)
+		if err != nil {
+			return nil, err
+		}
+	}
+	network := familyNetwork("udp", ipFamily(ip))
+	address := net.JoinHostPort(ip.String(), port)
+
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.ConnectStart != nil {
+		trace.ConnectStart(network, address)
+	}
+
+	lc, local := sourceListenConfig(ctx, net.ListenConfig{}, ":0")
+	socket, err := lc.ListenPacket(ctx, network, local)
+	if trace != nil && trace.ConnectDone != nil {
+		trace.ConnectDone(network, address, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: u.Hostname(),
+		NextProtos: []string{http3.NextProtoH3},
+	}
+
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	// Connections kept alive would otherwise be closed by the origin once idle between probes
+	config := &quic.Config{}
+	if t.keepAlive {
+		config.KeepAlivePeriod = h3KeepAlivePeriod
+	}
+
+	conn, err := quic.Dial(ctx, socket, udpAddr, tlsConfig, config)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		state := tls.ConnectionState{}
+		if conn != nil {
+			state = conn.ConnectionState().TLS
+		}
+		trace.TLSHandshakeDone(state, err)
+	}
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	return &h3Conn{
+		ClientConn: t.transport.NewClientConn(conn),
+		quic:       conn,
+		socket:     socket,
+	}, nil
+}
+
+func (t *h3Transport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+// connClosingBody closes the connection a response was received over with its body.
+type connClosingBody struct {
+	io.ReadCloser
+	conn io.Closer
+}
+
+func (b *connClosingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/monzo/terrors"
+	"golang.org/x/net/proxy"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// The proxy every origin without its own is probed through, if any
+var leafProxy *url.URL
+
+type proxyKey struct{}
+
+// withProxy makes connections dialled with the context go through the given proxy, which
+// connects to the origin on our behalf.
+func withProxy(ctx context.Context, proxyURL *url.URL) context.Context {
+	if proxyURL == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, proxyKey{}, proxyURL)
+}
+
+// originProxy returns the proxy to probe an origin through, which is its own if set, or
+// otherwise that of the leaf.
+func originProxy(origin types.OriginEntry) *url.URL {
+	if origin.Proxy == "" {
+		return leafProxy
+	}
+
+	// Proxies of origins are validated when the config is parsed
+	proxyURL, err := types.ParseProxy(origin.Proxy)
+	if err != nil {
+		return leafProxy
+	}
+
+	return proxyURL
+}
+
+// dialProxy connects to the proxy set in the context through the given dial, and asks it
+// to open a tunnel to the address. The connection to the proxy is traced as that to the
+// origin would be, while the time taken for the tunnel to open is traced separately.
+func dialProxy(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, address string) (net.Conn, error) {
+	proxyURL := ctx.Value(proxyKey{}).(*url.URL)
+
+	conn, err := dial(ctx, network, proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	trace := contextProbeTrace(ctx)
+	trace.proxyHandshakeStart()
+
+	var tunnel net.Conn
+	switch proxyURL.Scheme {
+	case "socks5":
+		tunnel, err = socks5Tunnel(ctx, conn, address, proxyURL)
+	default:
+		tunnel, err = connectTunnel(ctx, conn, address, proxyURL)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	trace.proxyHandshakeDone()
+
+	return tunnel, nil
+}
+
+// connectTunnel opens a tunnel through an HTTP proxy with a CONNECT request.
+func connectTunnel(ctx context.Context, conn net.Conn, address string, proxyURL *url.URL) (net.Conn, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	if err := req.Write(conn); err != nil {
+		return nil, proxyError(ctx, err)
+	}
+
+	br := bufio.NewReader(conn)
+	rsp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, proxyError(ctx, err)
+	}
+	rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode == http.StatusProxyAuthRequired:
+		return nil, terrors.Forbidden(reasonProxyAuth, fmt.Sprintf("Proxy %s did not accept our credentials", proxyURL.Host), map[string]string{
+			"reason": reasonProxyAuth,
+		})
+	case rsp.StatusCode < 200 || rsp.StatusCode > 299:
+		return nil, terrors.BadResponse(reasonProxyRejected, fmt.Sprintf("Proxy %s responded %s to CONNECT %s", proxyURL.Host, rsp.Status, address), map[string]string{
+			"reason": reasonProxyRejected,
+		})
+	}
+
+	// Anything the origin sent which was read along with the response must not be lost
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+
+	return conn, nil
+}
+
+// socks5Tunnel opens a tunnel through a SOCKS5 proxy, authenticating with a username and
+// password if given.
+func socks5Tunnel(ctx context.Context, conn net.Conn, address string, proxyURL *url.URL) (net.Conn, error) {
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{User: proxyURL.User.Username(), Password: password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", proxyURL.Host, auth, connectedDialer{conn})
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	tunnel, err := dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, proxyError(ctx, err)
+	}
+
+	return tunnel, nil
+}
+
+// connectedDialer hands the SOCKS5 client the connection already made to the proxy.
+type connectedDialer struct {
+	conn net.Conn
+}
+
+func (d connectedDialer) Dial(network, address string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+func (d connectedDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.conn, nil
+}
+
+// proxyError classifies the failure of a proxy to open a tunnel. SOCKS5 errors only say
+// what went wrong in their messages.
+func proxyError(ctx context.Context, err error) error {
+	var netErr net.Error
+	reason := reasonProxyFailure
+	switch {
+	case ctx.Err() != nil || (errors.As(err, &netErr) && netErr.Timeout()):
+		reason = reasonProxyTimeout
+	case strings.Contains(err.Error(), "authentication"):
+		reason = reasonProxyAuth
+	case strings.Contains(err.Error(), "unknown error"):
+		reason = reasonProxyRejected
+	}
+
+	return terrors.Wrap(err, map[string]string{
+		"reason": reason,
+	})
+}
+
+// bufferedConn is a connection part of which has already been read into a buffer.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
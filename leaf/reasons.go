@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// Reasons a probe failed, recorded in the reason label of probe results. These are kept
+// stable, so that alerts can tell an origin being down apart from a leaf failing to resolve
+// its hostname.
+const (
+	reasonDNSNXDomain        = "dns_nxdomain"
+	reasonDNSTimeout         = "dns_timeout"
+	reasonDNSFailure         = "dns_failure"
+	reasonDNSNoAddress       = "dns_no_address" // The hostname has no addresses of the family probed over
+	reasonConnectRefused     = "connect_refused"
+	reasonConnectTimeout     = "connect_timeout"
+	reasonConnectUnreach     = "connect_unreachable"
+	reasonConnectFailure     = "connect_failure"
+	reasonConnectionReset    = "connection_reset"
+	reasonConnectionClosed   = "connection_closed"
+	reasonProxyAuth          = "proxy_auth"     // The proxy did not accept the credentials given, if any
+	reasonProxyRejected      = "proxy_rejected" // The proxy refused or failed to open a tunnel to the origin
+	reasonProxyTimeout       = "proxy_timeout"
+	reasonProxyFailure       = "proxy_failure"
+	reasonProxyUnsupported   = "proxy_unsupported" // The protocol probed cannot be sent through the proxy of the leaf
+	reasonTLSHandshake       = "tls_handshake"
+	reasonTLSVerify          = "tls_verify"
+	reasonReadTimeout        = "read_timeout"
+	reasonReadFailure        = "read_failure"
+	reasonHTTPStatus4xx      = "http_status_4xx"
+	reasonHTTPStatus5xx      = "http_status_5xx"
+	reasonHTTPStatus         = "http_status_unexpected" // A status code below 400 which is not accepted
+	reasonProtocolMismatch   = "protocol_mismatch"      // The origin did not negotiate the protocol required
+	reasonBodyTooLarge       = "body_too_large"
+	reasonBodyMismatch       = "body_mismatch"
+	reasonJSONMismatch       = "json_mismatch"
+	reasonMalformedResponse  = "malformed_response"
+	reasonStaleToken         = "stale_token" // The token of the previous response was repeated
+	reasonStaleNonce         = "stale_nonce" // The nonce echoed back was not the one sent
+	reasonSignatureInvalid   = "signature_invalid"
+	reasonClockSkew          = "clock_skew" // The origin rejected the probe as sent too far from its own time
+	reasonBannerMismatch     = "banner_mismatch"
+	reasonTransferIncomplete = "transfer_incomplete" // Fewer bytes were transferred than requested
+	reasonNoReplies          = "no_replies"
+	reasonNotReached         = "not_reached"
+	reasonSocket             = "socket_error" // The leaf could not open the socket to probe with
+	reasonTimeout            = "timeout"      // The probe timed out at a point which is not known
+	reasonUnknown            = "unknown"
+)
+
+// wrapProbeError wraps an error as terrors do, keeping the reason it was classified as
+// before the error it wraps is lost.
+func wrapProbeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return terrors.Wrap(err, map[string]string{
+		"reason": classifyError(err),
+	})
+}
+
+// classifyError finds the reason a probe failed from the error it failed with, by looking
+// through the errors it wraps, or from the reason kept by wrapProbeError.
+func classifyError(err error) string {
+	var terr *terrors.Error
+	if errors.As(err, &terr) && terr.Params["reason"] != "" {
+		return terr.Params["reason"]
+	}
+
+	if terrors.PrefixMatches(err, terrors.ErrNotFound, "address") {
+		return reasonDNSNoAddress
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		switch {
+		case dnsErr.IsNotFound:
+			return reasonDNSNXDomain
+		case dnsErr.IsTimeout:
+			return reasonDNSTimeout
+		default:
+			return reasonDNSFailure
+		}
+	}
+
+	if isVerificationError(err) {
+		return reasonTLSVerify
+	}
+
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return reasonConnectRefused
+		case syscall.EHOSTUNREACH, syscall.ENETUNREACH:
+			return reasonConnectUnreach
+		case syscall.ECONNRESET, syscall.EPIPE:
+			return reasonConnectionReset
+		}
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		switch {
+		case opErr.Op == "dial" && opErr.Timeout():
+			return reasonConnectTimeout
+		case opErr.Op == "dial":
+			return reasonConnectFailure
+		case opErr.Timeout():
+			return reasonReadTimeout
+		default:
+			return reasonReadFailure
+		}
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return reasonConnectionClosed
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return reasonTimeout
+	}
+
+	return reasonUnknown
+}
+
+// isVerificationError returns whether an error is the failure to verify a certificate,
+// rather than some other failure of the TLS handshake.
+func isVerificationError(err error) bool {
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// classifyingTransport classifies errors returned by a transport before typhon wraps them,
+// which only keeps their messages.
+type classifyingTransport struct {
+	http.RoundTripper
+}
+
+func (t classifyingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := t.RoundTripper.RoundTrip(req)
+	return rsp, wrapProbeError(err)
+}
+
+// isStaleProbe returns whether an origin requiring signed probes rejected one as sent too far
+// from its own time, going by the error typhon encodes in the response.
+func isStaleProbe(statusCode int, header http.Header, body []byte) bool {
+	if statusCode != http.StatusUnauthorized || header.Get("Terror") != "1" {
+		return false
+	}
+
+	terr := struct {
+		Code string `json:"code"`
+	}{}
+	if err := json.Unmarshal(body, &terr); err != nil {
+		return false
+	}
+
+	return terr.Code == terrors.ErrUnauthorized+"."+types.StaleProbeCode
+}
+
+// statusReason classifies a status code which was not accepted.
+func statusReason(statusCode int) string {
+	switch {
+	case statusCode >= 500:
+		return reasonHTTPStatus5xx
+	case statusCode >= 400:
+		return reasonHTTPStatus4xx
+	default:
+		return reasonHTTPStatus
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/chongyangshi/oxcross/leaf/prompb"
+)
+
+const (
+	remoteWriteMinBackoff = time.Second
+	remoteWriteMaxBackoff = 5 * time.Minute
+	remoteWriteBatchExt   = ".batch"
+)
+
+// Reasons batches are dropped without being pushed
+const (
+	remoteWriteDroppedBufferFull = "buffer_full"
+	remoteWriteDroppedRejected   = "rejected"   // The receiver responded that it will never accept the batch
+	remoteWriteDroppedUnreadable = "unreadable" // The batch could not be read back from disk
+)
+
+// remoteWriteConfig configures pushing metrics to a Prometheus remote write receiver, for
+// leaves which Prometheus cannot scrape, such as those behind NAT.
+type remoteWriteConfig struct {
+	URL            string `json:"url"` // With optional credentials for basic auth
+	Dir            string `json:"dir"`
+	Interval       int    `json:"interval"`         // Seconds between samples being gathered
+	Timeout        int    `json:"timeout"`          // Seconds before a push is given up on
+	MaxBufferBytes int64  `json:"max_buffer_bytes"` // Oldest batches are dropped beyond this
+}
+
+// parseRemoteWriteConfig parses the remote write config of a leaf, as a JSON object.
+func parseRemoteWriteConfig(config string) (remoteWriteConfig, error) {
+	c := remoteWriteConfig{
+		Dir:            "/var/lib/oxcross-leaf/remote-write",
+		Interval:       15,
+		Timeout:        30,
+		MaxBufferBytes: 64 << 20,
+	}
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		return c, terrors.Wrap(err, nil)
+	}
+
+	u, err := url.Parse(c.URL)
+	switch {
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+		return c, terrors.BadRequest("invalid_remote_write", "Remote write url must be an http or https URL", nil)
+	case c.Dir == "":
+		return c, terrors.BadRequest("invalid_remote_write", "No remote write dir configured", nil)
+	case c.Interval < 1 || c.Timeout < 1:
+		return c, terrors.BadRequest("invalid_remote_write", "Remote write interval and timeout must be at least a second", nil)
+	case c.MaxBufferBytes < 1<<20:
+		return c, terrors.BadRequest("invalid_remote_write", "Remote write max_buffer_bytes must be at least 1 MiB", nil)
+	}
+
+	return c, nil
+}
+
+// startRemoteWrite gathers the metrics of the leaf every interval into batches written to
+// the buffer on disk, and pushes them from there to the receiver in the order gathered. Only
+// once a receiver has accepted a batch is it removed, so batches gathered while it cannot be
+// reached, including before the leaf restarts, are pushed with their original timestamps
+// once it can.
+func startRemoteWrite(ctx context.Context, config remoteWriteConfig) error {
+	queue, err := openRemoteWriteQueue(config.Dir, config.MaxBufferBytes)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(config.Interval) * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			series, err := gatherTimeSeries(prometheus.DefaultGatherer, time.Now())
+			if err != nil {
+				// Whatever could be gathered is still worth pushing
+				slog.Warn(ctx, "Error gathering metrics for remote write: %v", err)
+			}
+			if len(series) == 0 {
+				continue
+			}
+
+			payload, err := encodeWriteRequest(series)
+			if err != nil {
+				slog.Error(ctx, "Error encoding metrics for remote write: %v", err)
+				continue
+			}
+			if err := queue.append(payload, len(series)); err != nil {
+				slog.Error(ctx, "Error buffering metrics for remote write: %v", err)
+			}
+		}
+	}()
+
+	go (&remoteWriter{
+		url:     config.URL,
+		timeout: time.Duration(config.Timeout) * time.Second,
+		queue:   queue,
+	}).run(ctx)
+
+	return nil
+}
+
+// remoteWriteBatch is a batch of samples buffered on disk, named after the order in which it
+// was gathered and the number of samples in it.
+type remoteWriteBatch struct {
+	name    string
+	seq     uint64
+	samples int
+	bytes   int64
+}
+
+func parseBatchName(name string) (remoteWriteBatch, bool) {
+	parts := strings.Split(strings.TrimSuffix(name, remoteWriteBatchExt), "-")
+	if !strings.HasSuffix(name, remoteWriteBatchExt) || len(parts) != 2 {
+		return remoteWriteBatch{}, false
+	}
+
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return remoteWriteBatch{}, false
+	}
+	samples, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return remoteWriteBatch{}, false
+	}
+
+	return remoteWriteBatch{name: name, seq: seq, samples: samples}, true
+}
+
+// remoteWriteQueue is the buffer of batches on disk waiting to be pushed, oldest first.
+// Each batch is written to a file of its own, which is renamed into place once complete, so
+// that a leaf stopping part way through writing a batch does not leave it corrupted.
+type remoteWriteQueue struct {
+	dir      string
+	maxBytes int64
+	ready    chan struct{} // Signalled when a batch is added
+
+	mu      sync.Mutex
+	batches []remoteWriteBatch
+	bytes   int64
+	next    uint64
+}
+
+func openRemoteWriteQueue(dir string, maxBytes int64) (*remoteWriteQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	q := &remoteWriteQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ready:    make(chan struct{}, 1),
+	}
+	for _, file := range files {
+		// Batches which were never completed are of no use
+		if strings.HasSuffix(file.Name(), remoteWriteBatchExt+".tmp") {
+			os.Remove(filepath.Join(dir, file.Name()))
+			continue
+		}
+
+		batch, ok := parseBatchName(file.Name())
+		if !ok {
+			continue
+		}
+		batch.bytes = file.Size()
+		q.batches = append(q.batches, batch)
+		q.bytes += batch.bytes
+	}
+
+	sort.Slice(q.batches, func(i, j int) bool {
+		return q.batches[i].seq < q.batches[j].seq
+	})
+	if len(q.batches) > 0 {
+		q.next = q.batches[len(q.batches)-1].seq + 1
+	}
+	q.trim()
+	registerRemoteWriteQueue(len(q.batches), q.bytes)
+
+	return q, nil
+}
+
+// append writes a batch to the end of the queue, dropping the oldest batches if the buffer
+// would otherwise grow beyond its limit.
+func (q *remoteWriteQueue) append(payload []byte, samples int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	batch := remoteWriteBatch{
+		name:    fmt.Sprintf("%020d-%d%s", q.next, samples, remoteWriteBatchExt),
+		seq:     q.next,
+		samples: samples,
+		bytes:   int64(len(payload)),
+	}
+
+	tmp := filepath.Join(q.dir, batch.name+".tmp")
+	if err := ioutil.WriteFile(tmp, payload, 0600); err != nil {
+		os.Remove(tmp)
+		return terrors.Wrap(err, nil)
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, batch.name)); err != nil {
+		os.Remove(tmp)
+		return terrors.Wrap(err, nil)
+	}
+
+	q.next++
+	q.batches = append(q.batches, batch)
+	q.bytes += batch.bytes
+	q.trim()
+	registerRemoteWriteQueue(len(q.batches), q.bytes)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// trim drops the oldest batches while the buffer is beyond its limit, keeping the newest
+// batch however large it is.
+func (q *remoteWriteQueue) trim() {
+	for q.bytes > q.maxBytes && len(q.batches) > 1 {
+		q.removeLocked(q.batches[0])
+		registerRemoteWriteDropped(remoteWriteDroppedBufferFull)
+	}
+}
+
+// oldest returns the oldest batch in the queue along with its payload.
+func (q *remoteWriteQueue) oldest() (remoteWriteBatch, []byte, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.batches) == 0 {
+		return remoteWriteBatch{}, nil, false, nil
+	}
+
+	batch := q.batches[0]
+	payload, err := ioutil.ReadFile(filepath.Join(q.dir, batch.name))
+	if err != nil {
+		return batch, nil, true, terrors.Wrap(err, nil)
+	}
+
+	return batch, payload, true, nil
+}
+
+// remove removes a batch from the queue, unless it was already dropped.
+func (q *remoteWriteQueue) remove(batch remoteWriteBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.removeLocked(batch)
+	registerRemoteWriteQueue(len(q.batches), q.bytes)
+}
+
+func (q *remoteWriteQueue) removeLocked(batch remoteWriteBatch) {
+	for i, b := range q.batches {
+		if b.seq != batch.seq {
+			continue
+		}
+		os.Remove(filepath.Join(q.dir, b.name))
+		q.batches = append(q.batches[:i], q.batches[i+1:]...)
+		q.bytes -= b.bytes
+		return
+	}
+}
+
+// remoteWriter pushes batches from the queue to the receiver one at a time, backing off
+// while the receiver cannot be reached or fails to accept them.
+type remoteWriter struct {
+	url     string
+	timeout time.Duration
+	queue   *remoteWriteQueue
+}
+
+func (w *remoteWriter) run(ctx context.Context) {
+	backoff := remoteWriteMinBackoff
+	for {
+		batch, payload, found, err := w.queue.oldest()
+		if !found {
+			<-w.queue.ready
+			continue
+		}
+		if err != nil {
+			slog.Error(ctx, "Error reading remote write batch %s, dropping it: %v", batch.name, err)
+			w.queue.remove(batch)
+			registerRemoteWriteDropped(remoteWriteDroppedUnreadable)
+			continue
+		}
+
+		retryable, err := w.send(ctx, payload)
+		if err == nil {
+			w.queue.remove(batch)
+			registerRemoteWriteSent(batch.samples)
+			backoff = remoteWriteMinBackoff
+			continue
+		}
+		registerRemoteWriteFailure(retryable)
+
+		// Receivers reject samples they will never accept, such as those too old to ingest
+		if !retryable {
+			slog.Error(ctx, "Remote write receiver rejected batch %s, dropping it: %v", batch.name, err)
+			w.queue.remove(batch)
+			registerRemoteWriteDropped(remoteWriteDroppedRejected)
+			continue
+		}
+
+		slog.Warn(ctx, "Error pushing remote write batch %s, retrying in %v: %v", batch.name, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > remoteWriteMaxBackoff {
+			backoff = remoteWriteMaxBackoff
+		}
+	}
+}
+
+// send pushes a batch to the receiver, returning whether it is worth retrying if it failed.
+// Only batches the receiver finds malformed, with a 400 status, are not retried, as they
+// would fail again. Other failures, such as expired credentials or a receiver not yet
+// routed to, may be fixed while the batch is still buffered.
+func (w *remoteWriter) send(ctx context.Context, payload []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	req := typhon.NewRequest(ctx, http.MethodPost, w.url, nil)
+	req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	req.ContentLength = int64(len(payload))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "oxcross-leaf")
+	if req.URL.User != nil {
+		password, _ := req.URL.User.Password()
+		req.SetBasicAuth(req.URL.User.Username(), password)
+		req.URL.User = nil
+	}
+
+	rsp := req.Send().Response()
+	if rsp.Error != nil || rsp.Response == nil {
+		return true, rsp.Error
+	}
+	rsp.Body.Close()
+
+	switch {
+	case rsp.StatusCode >= 200 && rsp.StatusCode <= 299:
+		return false, nil
+	case rsp.StatusCode == http.StatusBadRequest:
+		return false, terrors.BadResponse("remote_write_rejected", fmt.Sprintf("Receiver responded with status %d", rsp.StatusCode), nil)
+	default:
+		return true, terrors.BadResponse("remote_write_failed", fmt.Sprintf("Receiver responded with status %d", rsp.StatusCode), nil)
+	}
+}
+
+// timeSeries is a single sample of a series, as sent in remote write requests.
+type timeSeries struct {
+	labels    [][2]string // Sorted by name
+	value     float64
+	timestamp int64 // In milliseconds since the Unix epoch
+}
+
+// gatherTimeSeries gathers the metrics of the leaf as a sample of each series, as they
+// would be ingested if scraped at the time given. Series are identified by the job and the
+// ID of the leaf, as scrapes of the leaf would be.
+//
+// Samples are not marked stale when their series disappear, as they are when scraped, so
+// series removed by the leaf end at their last sample instead.
+func gatherTimeSeries(gatherer prometheus.Gatherer, now time.Time) ([]timeSeries, error) {
+	families, err := gatherer.Gather()
+
+	series := []timeSeries{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			timestamp := now.UnixNano() / int64(time.Millisecond)
+			if m.TimestampMs != nil {
+				timestamp = m.GetTimestampMs()
+			}
+
+			add := func(suffix string, value float64, extra ...string) {
+				labels := [][2]string{{"__name__", family.GetName() + suffix}, {"job", "oxcross-leaf"}, {"instance", leafID}}
+				// Labels with empty values are the same as no label, and are dropped when scraped
+				for _, label := range m.GetLabel() {
+					if label.GetValue() != "" {
+						labels = append(labels, [2]string{label.GetName(), label.GetValue()})
+					}
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					labels = append(labels, [2]string{extra[i], extra[i+1]})
+				}
+				sort.Slice(labels, func(i, j int) bool {
+					return labels[i][0] < labels[j][0]
+				})
+				series = append(series, timeSeries{labels: labels, value: value, timestamp: timestamp})
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, bucket := range h.GetBucket() {
+					add("_bucket", float64(bucket.GetCumulativeCount()), "le", formatFloat(bucket.GetUpperBound()))
+				}
+				add("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, quantile := range s.GetQuantile() {
+					add("", quantile.GetValue(), "quantile", formatFloat(quantile.GetQuantile()))
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+
+	return series, err
+}
+
+// formatFloat formats bucket bounds and quantiles as the text exposition format does.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+}
+
+// encodeWriteRequest encodes samples as the WriteRequest message of remote write, compressed
+// with snappy as receivers expect.
+func encodeWriteRequest(series []timeSeries) ([]byte, error) {
+	req := &prompb.WriteRequest{}
+	for _, s := range series {
+		ts := &prompb.TimeSeries{
+			Samples: []*prompb.Sample{{Value: s.value, Timestamp: s.timestamp}},
+		}
+		for _, label := range s.labels {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: label[0], Value: label[1]})
+		}
+		req.Timeseries = append(req.Timeseries, ts)
+	}
+
+	encoded, err := proto.Marshal(req)
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	return snappy.Encode(nil, encoded), nil
+}
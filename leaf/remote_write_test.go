@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/chongyangshi/oxcross/leaf/prompb"
+)
+
+// remoteWriteReceiver decodes the requests it is sent, responding with the given statuses
+// in turn and with 204 once they run out.
+type remoteWriteReceiver struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	statuses []int
+	received []*prompb.WriteRequest
+	done     chan struct{}
+	expected int
+}
+
+func (r *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		r.t.Errorf("unexpected headers %v", req.Header)
+	}
+	if user, password, ok := req.BasicAuth(); !ok || user != "leaf" || password != "secret" {
+		r.t.Errorf("expected basic auth as leaf, got %q, %q", user, password)
+	}
+
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		r.t.Error(err)
+		return
+	}
+	encoded, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		r.t.Errorf("error decoding snappy: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	writeRequest := &prompb.WriteRequest{}
+	if err := proto.Unmarshal(encoded, writeRequest); err != nil {
+		r.t.Errorf("error decoding write request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	r.received = append(r.received, writeRequest)
+	if len(r.received) == r.expected {
+		close(r.done)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newRemoteWriteReceiver(t *testing.T, expected int, statuses ...int) (*remoteWriteReceiver, *httptest.Server) {
+	receiver := &remoteWriteReceiver{
+		t:        t,
+		statuses: statuses,
+		done:     make(chan struct{}),
+		expected: expected,
+	}
+	server := httptest.NewServer(receiver)
+	server.URL = "http://leaf:secret@" + server.Listener.Addr().String()
+
+	return receiver, server
+}
+
+func testTimeSeries(origin string, value float64) []timeSeries {
+	return []timeSeries{{
+		labels:    [][2]string{{"__name__", "oxcross_leaf_origin_status"}, {"instance", "leaf1"}, {"job", "oxcross-leaf"}, {"origin_id", origin}},
+		value:     value,
+		timestamp: 1700000000000,
+	}}
+}
+
+func checkWriteRequest(t *testing.T, writeRequest *prompb.WriteRequest, origin string, value float64) {
+	if len(writeRequest.Timeseries) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(writeRequest.Timeseries))
+	}
+	series := writeRequest.Timeseries[0]
+
+	expected := testTimeSeries(origin, value)[0]
+	if len(series.Labels) != len(expected.labels) {
+		t.Fatalf("expected labels %v, got %v", expected.labels, series.Labels)
+	}
+	for i, label := range series.Labels {
+		if label.Name != expected.labels[i][0] || label.Value != expected.labels[i][1] {
+			t.Errorf("expected label %s=%q, got %s=%q", expected.labels[i][0], expected.labels[i][1], label.Name, label.Value)
+		}
+	}
+
+	if len(series.Samples) != 1 || series.Samples[0].Value != value || series.Samples[0].Timestamp != expected.timestamp {
+		t.Errorf("expected a sample of %v at %d, got %v", value, expected.timestamp, series.Samples)
+	}
+}
+
+func TestRemoteWriteSendRetries(t *testing.T) {
+	cases := []struct {
+		status    int
+		retryable bool
+		failed    bool
+	}{
+		{http.StatusNoContent, false, false},
+		{http.StatusBadRequest, false, true},
+		{http.StatusUnauthorized, true, true},
+		{http.StatusForbidden, true, true},
+		{http.StatusTooManyRequests, true, true},
+		{http.StatusInternalServerError, true, true},
+		{http.StatusServiceUnavailable, true, true},
+	}
+
+	for _, c := range cases {
+		_, server := newRemoteWriteReceiver(t, 1, c.status)
+		w := &remoteWriter{url: server.URL, timeout: time.Second}
+
+		payload, err := encodeWriteRequest(testTimeSeries("origin", 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		retryable, err := w.send(context.Background(), payload)
+		if retryable != c.retryable || (err != nil) != c.failed {
+			t.Errorf("expected status %d to be retryable %v and failed %v, got %v and %v", c.status, c.retryable, c.failed, retryable, err)
+		}
+		server.Close()
+	}
+}
+
+func TestRemoteWriteReplaysQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oxcross-remote-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Batches buffered before the leaf restarts are kept, while one it stopped part way
+	// through writing is discarded
+	queue, err := openRemoteWriteQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, origin := range []string{"first", "second"} {
+		payload, err := encodeWriteRequest(testTimeSeries(origin, float64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := queue.append(payload, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "00000000000000000002-1.batch.tmp"), []byte("partial"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err = openRemoteWriteQueue(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue.batches) != 2 || queue.next != 2 {
+		t.Fatalf("expected 2 batches to be replayed, got %v", queue.batches)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00000000000000000002-1.batch.tmp")); !os.IsNotExist(err) {
+		t.Errorf("expected the incomplete batch to be removed, got %v", err)
+	}
+
+	// The first push fails with credentials the receiver does not accept, and is retried
+	receiver, server := newRemoteWriteReceiver(t, 2, http.StatusUnauthorized)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&remoteWriter{url: server.URL, timeout: time.Second, queue: queue}).run(ctx)
+
+	select {
+	case <-receiver.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the receiver to accept both batches")
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	checkWriteRequest(t, receiver.received[0], "first", 0)
+	checkWriteRequest(t, receiver.received[1], "second", 1)
+
+	// Batches are only removed from disk once accepted
+	deadline := time.Now().Add(time.Second)
+	for {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected accepted batches to be removed, found %d files", len(files))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGatherTimeSeries(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "oxcross_leaf_origin_status",
+		Help: "Test gauge",
+	}, []string{"origin_id", "target_ip"})
+	registry.MustRegister(gauge)
+	gauge.WithLabelValues("origin", "").Set(1)
+
+	series, err := gatherTimeSeries(registry, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Labels with empty values are dropped as they would be when scraped
+	expected := testTimeSeries("origin", 1)[0]
+	expected.labels[1][1] = leafID
+	if len(series) != 1 || len(series[0].labels) != len(expected.labels) {
+		t.Fatalf("expected %v, got %v", expected, series)
+	}
+	for i, label := range series[0].labels {
+		if label != expected.labels[i] {
+			t.Errorf("expected labels %v, got %v", expected.labels, series[0].labels)
+			break
+		}
+	}
+	if series[0].value != 1 || series[0].timestamp != expected.timestamp {
+		t.Errorf("expected a sample of 1 at %d, got %v at %d", expected.timestamp, series[0].value, series[0].timestamp)
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+)
+
+const (
+	resultLogSinkName   = "result_log"
+	resultLogFilePrefix = "results-"
+	resultLogFileExt    = ".jsonl"
+
+	// Raw results served by each query, which narrower time ranges page through
+	resultLogDefaultLimit = 1000
+	resultLogMaxLimit     = 10000
+)
+
+// resultLogConfig configures logging every probe result to files on the leaf, which are
+// rotated by size and age, and removed once past retention or the total size allowed.
+type resultLogConfig struct {
+	Dir          string `json:"dir"`
+	MaxFileBytes int64  `json:"max_file_bytes"`
+	MaxFileAge   int    `json:"max_file_age"` // Seconds before a file is rotated
+	MaxBytes     int64  `json:"max_bytes"`    // Oldest files are removed beyond this
+	Retention    int    `json:"retention"`    // Seconds results are kept for
+}
+
+// parseResultLogConfig parses the result log config of a leaf, as a JSON object.
+func parseResultLogConfig(config string) (resultLogConfig, error) {
+	c := resultLogConfig{
+		Dir:          "/var/lib/oxcross-leaf/results",
+		MaxFileBytes: 8 << 20,
+		MaxFileAge:   3600,
+		MaxBytes:     64 << 20,
+		Retention:    7 * 24 * 3600,
+	}
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		return c, terrors.Wrap(err, nil)
+	}
+
+	switch {
+	case c.Dir == "":
+		return c, terrors.BadRequest("invalid_result_log", "No result log dir configured", nil)
+	case c.MaxFileBytes < 64<<10:
+		return c, terrors.BadRequest("invalid_result_log", "Result log max_file_bytes must be at least 64 KiB", nil)
+	case c.MaxBytes < 2*c.MaxFileBytes:
+		return c, terrors.BadRequest("invalid_result_log", "Result log max_bytes must be at least twice max_file_bytes", nil)
+	case c.MaxFileAge < 1 || c.Retention < 1:
+		return c, terrors.BadRequest("invalid_result_log", "Result log max_file_age and retention must be at least a second", nil)
+	}
+
+	return c, nil
+}
+
+// loggedResult is a probe result as logged and served, with the labels of the probe as in
+// metrics, and timings in seconds.
+type loggedResult struct {
+	Time       time.Time `json:"time"`
+	OriginID   string    `json:"origin_id"`
+	SourceID   string    `json:"source_id,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Resolver   string    `json:"resolver,omitempty"`
+	IPFamily   string    `json:"ip_family,omitempty"`
+	TargetIP   string    `json:"target_ip,omitempty"`
+	Connection string    `json:"connection,omitempty"`
+
+	Result     bool   `json:"result"`
+	Reason     string `json:"reason,omitempty"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Protocol   string `json:"protocol,omitempty"`
+
+	DurationSeconds     float64 `json:"duration_seconds,omitempty"`
+	DNSSeconds          float64 `json:"dns_seconds,omitempty"`
+	ConnectSeconds      float64 `json:"connect_seconds,omitempty"`
+	ProxySeconds        float64 `json:"proxy_seconds,omitempty"`
+	TLSHandshakeSeconds float64 `json:"tls_handshake_seconds,omitempty"`
+	ServerSeconds       float64 `json:"server_seconds,omitempty"`
+	TransferSeconds     float64 `json:"transfer_seconds,omitempty"`
+}
+
+func newLoggedResult(result probeResult) loggedResult {
+	return loggedResult{
+		Time:                result.Time,
+		OriginID:            result.Labels.OriginID,
+		SourceID:            result.Labels.SourceID,
+		Source:              result.Labels.Source,
+		Resolver:            result.Labels.Resolver,
+		IPFamily:            result.Labels.IPFamily,
+		TargetIP:            result.Labels.TargetIP,
+		Connection:          result.Labels.Connection,
+		Result:              result.Result,
+		Reason:              result.Reason,
+		StatusCode:          result.StatusCode,
+		Protocol:            result.Protocol,
+		DurationSeconds:     result.Duration.Seconds(),
+		DNSSeconds:          result.Phases.DNS.Seconds(),
+		ConnectSeconds:      result.Phases.Connect.Seconds(),
+		ProxySeconds:        result.Phases.Proxy.Seconds(),
+		TLSHandshakeSeconds: result.Phases.TLS.Seconds(),
+		ServerSeconds:       result.Phases.Server.Seconds(),
+		TransferSeconds:     result.Phases.Transfer.Seconds(),
+	}
+}
+
+func (r loggedResult) labels() probeLabels {
+	return probeLabels{
+		OriginID:   r.OriginID,
+		SourceID:   r.SourceID,
+		Source:     r.Source,
+		Resolver:   r.Resolver,
+		IPFamily:   r.IPFamily,
+		TargetIP:   r.TargetIP,
+		Connection: r.Connection,
+	}
+}
+
+// The result log of the leaf if configured, which queries are served from
+var localResults *resultLog
+
+// resultLogFile is a file of results, named after the time it was started.
+type resultLogFile struct {
+	path     string
+	started  time.Time
+	modified time.Time
+	size     int64
+}
+
+// resultLog appends results to the latest of its files, starting a new one once the latest
+// would exceed max_file_bytes or max_file_age. Before a file is started, older files are
+// removed so that the files, including the new one at its largest, stay within max_bytes.
+type resultLog struct {
+	config resultLogConfig
+
+	mu      sync.Mutex
+	files   []resultLogFile // In the order they were started
+	current *os.File
+}
+
+// startResultLog opens the result log, and starts logging every probe result to it.
+func startResultLog(ctx context.Context, config resultLogConfig) error {
+	log, err := openResultLog(config)
+	if err != nil {
+		return err
+	}
+
+	localResults = log
+	addResultSink(ctx, resultLogSinkName, log.write)
+
+	// Files past retention are also removed while no results are being logged
+	go func() {
+		for range time.Tick(time.Minute) {
+			log.mu.Lock()
+			log.prune(time.Now(), 0)
+			log.mu.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+func openResultLog(config resultLogConfig) (*resultLog, error) {
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	entries, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	log := &resultLog{config: config}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, resultLogFilePrefix) || !strings.HasSuffix(name, resultLogFileExt) {
+			continue
+		}
+		started, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, resultLogFilePrefix), resultLogFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		log.files = append(log.files, resultLogFile{
+			path:     filepath.Join(config.Dir, name),
+			started:  time.Unix(0, started),
+			modified: entry.ModTime(),
+			size:     entry.Size(),
+		})
+	}
+	sort.Slice(log.files, func(i, j int) bool {
+		return log.files[i].started.Before(log.files[j].started)
+	})
+
+	// Files left by an earlier run are never appended to, as the leaf may have stopped
+	// halfway through a line
+	log.prune(time.Now(), 0)
+
+	return log, nil
+}
+
+func (l *resultLog) write(ctx context.Context, results []probeResult) error {
+	lines := bytes.Buffer{}
+	encoder := json.NewEncoder(&lines)
+	for _, result := range results {
+		if err := encoder.Encode(newLoggedResult(result)); err != nil {
+			return terrors.Wrap(err, nil)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.current != nil {
+		latest := l.files[len(l.files)-1]
+		if latest.size+int64(lines.Len()) > l.config.MaxFileBytes || now.Sub(latest.started) >= time.Duration(l.config.MaxFileAge)*time.Second {
+			if err := l.current.Close(); err != nil {
+				slog.Warn(ctx, "Error closing result log file %s: %v", latest.path, err)
+			}
+			l.current = nil
+		}
+	}
+
+	if l.current == nil {
+		l.prune(now, l.config.MaxFileBytes)
+
+		path := filepath.Join(l.config.Dir, fmt.Sprintf("%s%020d%s", resultLogFilePrefix, now.UnixNano(), resultLogFileExt))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return terrors.Wrap(err, nil)
+		}
+		l.current = f
+		l.files = append(l.files, resultLogFile{path: path, started: now})
+	}
+
+	// A single batch larger than a file is cut short rather than exceeding the caps
+	data := lines.Bytes()
+	latest := &l.files[len(l.files)-1]
+	if room := l.config.MaxFileBytes - latest.size; int64(len(data)) > room {
+		data = data[:bytes.LastIndexByte(data[:room], '\n')+1]
+	}
+
+	n, err := l.current.Write(data)
+	latest.size += int64(n)
+	latest.modified = now
+	l.registerFiles()
+	if err != nil {
+		return terrors.Wrap(err, nil)
+	}
+	if n < lines.Len() {
+		return terrors.InternalService("result_log_full", fmt.Sprintf("Result log dropped %d bytes of results which did not fit in a file", lines.Len()-n), nil)
+	}
+
+	return nil
+}
+
+// prune removes files last written to before the retention period, and the oldest files
+// until those left and another of the given size fit within max_bytes. The file currently
+// appended to is never removed.
+func (l *resultLog) prune(now time.Time, reserve int64) {
+	total := reserve
+	for _, file := range l.files {
+		total += file.size
+	}
+
+	kept := []resultLogFile{}
+	for i, file := range l.files {
+		current := l.current != nil && i == len(l.files)-1
+		expired := now.Sub(file.modified) > time.Duration(l.config.Retention)*time.Second
+		if !current && (expired || total > l.config.MaxBytes) {
+			if err := os.Remove(file.path); err == nil || os.IsNotExist(err) {
+				total -= file.size
+				continue
+			} else {
+				slog.Error(context.Background(), "Error removing result log file %s: %v", file.path, err)
+			}
+		}
+		kept = append(kept, file)
+	}
+	l.files = kept
+
+	l.registerFiles()
+}
+
+func (l *resultLog) registerFiles() {
+	var size int64
+	for _, file := range l.files {
+		size += file.size
+	}
+	registerResultLogFiles(len(l.files), size)
+}
+
+// resultQuery selects logged results by the labels of their probes and a time range.
+type resultQuery struct {
+	OriginID string
+	SourceID string
+	From     time.Time // Inclusive, unbounded if zero
+	To       time.Time // Exclusive, unbounded if zero
+}
+
+func (q resultQuery) matches(result loggedResult) bool {
+	switch {
+	case q.OriginID != "" && result.OriginID != q.OriginID:
+		return false
+	case q.SourceID != "" && result.SourceID != q.SourceID:
+		return false
+	case !q.From.IsZero() && result.Time.Before(q.From):
+		return false
+	case !q.To.IsZero() && !result.Time.Before(q.To):
+		return false
+	}
+
+	return true
+}
+
+// scan calls fn with each logged result matching the query in the order they were logged,
+// until it returns false. Files which cannot contain results in the time range are skipped,
+// as are lines which cannot be parsed, such as one being written.
+func (l *resultLog) scan(query resultQuery, fn func(result loggedResult) bool) error {
+	l.mu.Lock()
+	files := append([]resultLogFile{}, l.files...)
+	l.mu.Unlock()
+
+	for i, file := range files {
+		if !query.To.IsZero() && !file.started.Before(query.To) {
+			break
+		}
+		if !query.From.IsZero() && i+1 < len(files) && files[i+1].started.Before(query.From) {
+			continue
+		}
+
+		more, err := scanResultLogFile(file.path, query, fn)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func scanResultLogFile(path string, query resultQuery, fn func(result loggedResult) bool) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Removed since the query started
+		return true, nil
+	} else if err != nil {
+		return false, terrors.Wrap(err, nil)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for scanner.Scan() {
+		result := loggedResult{}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			continue
+		}
+		if query.matches(result) && !fn(result) {
+			return false, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, terrors.Wrap(err, nil)
+	}
+
+	return true, nil
+}
+
+// parseResultQuery parses the origin_id, source_id, from and to query parameters of a
+// request, where times are either RFC 3339 or seconds since the Unix epoch.
+func parseResultQuery(r *http.Request) (resultQuery, error) {
+	params := r.URL.Query()
+	query := resultQuery{
+		OriginID: params.Get("origin_id"),
+		SourceID: params.Get("source_id"),
+	}
+
+	for param, t := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+		value := params.Get(param)
+		if value == "" {
+			continue
+		}
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			*t = time.Unix(0, int64(seconds*float64(time.Second)))
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return query, terrors.BadRequest("invalid_time", fmt.Sprintf("Invalid %s time %q, which must be RFC 3339 or seconds since the epoch", param, value), nil)
+		}
+		*t = parsed
+	}
+
+	return query, nil
+}
+
+// serveResults serves the raw results logged which match the query, earliest first, up to a
+// limit. Whether results beyond the limit were left out is served alongside them.
+func serveResults(w http.ResponseWriter, r *http.Request) {
+	query, err := parseResultQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := resultLogDefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > resultLogMaxLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit %q, which must be between 1 and %d", value, resultLogMaxLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rsp := struct {
+		Results   []loggedResult `json:"results"`
+		Truncated bool           `json:"truncated"`
+	}{Results: []loggedResult{}}
+	err = localResults.scan(query, func(result loggedResult) bool {
+		if len(rsp.Results) == limit {
+			rsp.Truncated = true
+			return false
+		}
+		rsp.Results = append(rsp.Results, result)
+		return true
+	})
+	if err != nil {
+		slog.Error(r.Context(), "Error querying result log: %v", err)
+		http.Error(w, "Error querying result log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		slog.Error(r.Context(), "Error serving results: %v", err)
+	}
+}
+
+// resultSummary summarises the results logged of a probe, with percentiles of the duration
+// of those which succeeded and were timed.
+type resultSummary struct {
+	Labels      map[string]string  `json:"labels"`
+	Count       int                `json:"count"`
+	Failures    int                `json:"failures"`
+	Percentiles map[string]float64 `json:"duration_seconds_percentiles"`
+
+	durations []float64
+}
+
+// serveResultPercentiles serves a summary of the results logged which match the query for
+// each probe, as distinguished by labels in metrics, with the percentiles given in the
+// percentiles query parameter, or the 50th, 90th and 99th by default.
+func serveResultPercentiles(w http.ResponseWriter, r *http.Request) {
+	query, err := parseResultQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	percentiles := []float64{50, 90, 99}
+	if value := r.URL.Query().Get("percentiles"); value != "" {
+		percentiles = []float64{}
+		for _, p := range strings.Split(value, ",") {
+			percentile, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || percentile <= 0 || percentile > 100 {
+				http.Error(w, fmt.Sprintf("Invalid percentile %q, which must be above 0 and up to 100", p), http.StatusBadRequest)
+				return
+			}
+			percentiles = append(percentiles, percentile)
+		}
+	}
+
+	summaries := map[string]*resultSummary{}
+	err = localResults.scan(query, func(result loggedResult) bool {
+		labels := result.labels()
+		key := strings.Join(labels.values(), "/")
+		summary, ok := summaries[key]
+		if !ok {
+			summary = &resultSummary{Labels: map[string]string{}, Percentiles: map[string]float64{}}
+			for _, tag := range (probeResult{Labels: labels}).tags() {
+				summary.Labels[tag[0]] = tag[1]
+			}
+			summaries[key] = summary
+		}
+
+		summary.Count++
+		if !result.Result {
+			summary.Failures++
+		} else if result.DurationSeconds > 0 {
+			summary.durations = append(summary.durations, result.DurationSeconds)
+		}
+		return true
+	})
+	if err != nil {
+		slog.Error(r.Context(), "Error querying result log: %v", err)
+		http.Error(w, "Error querying result log", http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]string, 0, len(summaries))
+	for key := range summaries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	rsp := []*resultSummary{}
+	for _, key := range keys {
+		summary := summaries[key]
+		sort.Float64s(summary.durations)
+		for _, percentile := range percentiles {
+			if len(summary.durations) > 0 {
+				summary.Percentiles["p"+strconv.FormatFloat(percentile, 'f', -1, 64)] = nearestRank(summary.durations, percentile)
+			}
+		}
+		rsp = append(rsp, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(rsp); err != nil {
+		slog.Error(r.Context(), "Error serving result percentiles: %v", err)
+	}
+}
+
+// nearestRank returns the given percentile of sorted values, as the smallest value which at
+// least that percentage of values are at most.
+func nearestRank(sorted []float64, percentile float64) float64 {
+	rank := int(math.Ceil(percentile / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+)
+
+// The number of results each sink buffers while sending earlier ones, beyond which results
+// are dropped rather than holding up probes.
+const sinkBufferSize = 1000
+
+// probeResult is the outcome of a single probe, which sinks receive as soon as it is known,
+// rather than aggregated as in metrics.
+type probeResult struct {
+	Labels     probeLabels
+	Time       time.Time
+	Result     bool
+	Reason     string
+	StatusCode int           // Only set for HTTP probes which received a response
+	Protocol   string        // Only set for HTTP probes which succeeded
+	Duration   time.Duration // Only set for probes which succeeded and time their round trips
+	Phases     probePhases
+}
+
+// tags returns the labels identifying the probe, as in metrics, leaving out those which are
+// not set.
+func (r probeResult) tags() [][2]string {
+	tags := [][2]string{}
+	for i, value := range r.Labels.values() {
+		if value != "" {
+			tags = append(tags, [2]string{probeLabelNames[i], value})
+		}
+	}
+
+	return tags
+}
+
+// Sinks every probe result is published to, as configured for the leaf
+var resultSinks []*resultSink
+
+func publishProbeResult(result probeResult) {
+	for _, sink := range resultSinks {
+		sink.send(result)
+	}
+}
+
+// resultSink sends probe results to a destination, such as a time series database, in the
+// order they are published. Results published while earlier ones are being sent are sent
+// together once they have been.
+type resultSink struct {
+	name    string
+	results chan probeResult
+	write   func(ctx context.Context, results []probeResult) error
+}
+
+func (s *resultSink) send(result probeResult) {
+	select {
+	case s.results <- result:
+	default:
+		registerSinkDropped(s.name)
+	}
+}
+
+func (s *resultSink) run(ctx context.Context) {
+	for result := range s.results {
+		results := []probeResult{result}
+	pending:
+		for len(results) < sinkBufferSize {
+			select {
+			case result := <-s.results:
+				results = append(results, result)
+			default:
+				break pending
+			}
+		}
+
+		if err := s.write(ctx, results); err != nil {
+			registerSinkFailure(s.name)
+			slog.Error(ctx, "Error sending %d probe results to sink %s: %v", len(results), s.name, err)
+		}
+	}
+}
+
+// sinkConfig configures a sink which probe results are sent to.
+type sinkConfig struct {
+	Name string `json:"name"` // Identifies the sink in metrics and logs, its type by default
+	Type string `json:"type"`
+
+	// For InfluxDB sinks, the http:// or https:// URL of the write endpoint, such as
+	// https://influxdb.example.com/api/v2/write?org=example&bucket=oxcross, or a udp://
+	// address. For StatsD sinks, the host:port to send to over UDP.
+	URL string `json:"url"`
+
+	Headers     map[string]string `json:"headers"`     // For InfluxDB sinks over HTTP, such as for authentication
+	Measurement string            `json:"measurement"` // For InfluxDB sinks, oxcross_probe by default
+	Timeout     int               `json:"timeout"`     // For InfluxDB sinks over HTTP, in seconds
+
+	Prefix string `json:"prefix"` // For StatsD sinks, oxcross by default
+	Format string `json:"format"` // For StatsD sinks, dogstatsd by default
+}
+
+// Types of sinks
+const (
+	sinkTypeInfluxDB = "influxdb"
+	sinkTypeStatsD   = "statsd"
+)
+
+// parseSinkConfigs parses the sinks of a leaf, as a JSON list.
+func parseSinkConfigs(config string) ([]sinkConfig, error) {
+	sinks := []sinkConfig{}
+	if err := json.Unmarshal([]byte(config), &sinks); err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	names := map[string]bool{}
+	for i, sink := range sinks {
+		if sink.Name == "" {
+			sink.Name = sink.Type
+		}
+		if names[sink.Name] {
+			return nil, terrors.BadRequest("invalid_sink", fmt.Sprintf("Duplicate sink %s, sinks of the same type need a name", sink.Name), nil)
+		}
+		names[sink.Name] = true
+
+		var err error
+		switch sink.Type {
+		case sinkTypeInfluxDB:
+			sink, err = validateInfluxDBSink(sink)
+		case sinkTypeStatsD:
+			sink, err = validateStatsDSink(sink)
+		default:
+			err = terrors.BadRequest("invalid_sink", fmt.Sprintf("Unsupported type %q of sink %s", sink.Type, sink.Name), nil)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sinks[i] = sink
+	}
+
+	return sinks, nil
+}
+
+// startSinks starts sending probe results to each sink configured.
+func startSinks(ctx context.Context, configs []sinkConfig) error {
+	for _, config := range configs {
+		var write func(ctx context.Context, results []probeResult) error
+		var err error
+		switch config.Type {
+		case sinkTypeInfluxDB:
+			write, err = newInfluxDBWriter(config)
+		case sinkTypeStatsD:
+			write, err = newStatsDWriter(config)
+		}
+		if err != nil {
+			return err
+		}
+		addResultSink(ctx, config.Name, write)
+	}
+
+	return nil
+}
+
+// addResultSink starts publishing probe results to a sink, which must happen before probes
+// start.
+func addResultSink(ctx context.Context, name string, write func(ctx context.Context, results []probeResult) error) {
+	sink := &resultSink{
+		name:    name,
+		results: make(chan probeResult, sinkBufferSize),
+		write:   write,
+	}
+	resultSinks = append(resultSinks, sink)
+	go sink.run(ctx)
+}
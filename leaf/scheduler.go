@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// scheduler probes each origin on its own interval, independently of other origins. Each
+// origin starts at a random point within its interval, so that probes are spread out
+// rather than all sent at once.
+type scheduler struct {
+	ctx context.Context
+
+	mu        sync.Mutex
+	scheduled map[string]*scheduledOrigin
+	stopping  map[string]<-chan struct{} // Closed once the probes of a stopped origin have finished
+	random    *rand.Rand
+}
+
+// scheduledProbe is an origin to be probed with a particular set of labels.
+type scheduledProbe struct {
+	origin types.OriginEntry
+	source probeSource
+	labels probeLabels
+}
+
+// scheduledOrigin is an origin being probed, until its context is cancelled.
+type scheduledOrigin struct {
+	config string // The origin as configured, to tell whether it has changed
+	cancel context.CancelFunc
+	done   <-chan struct{} // Closed once its probes have finished after being cancelled
+}
+
+func newScheduler(ctx context.Context) *scheduler {
+	return &scheduler{
+		ctx:       ctx,
+		scheduled: map[string]*scheduledOrigin{},
+		stopping:  map[string]<-chan struct{}{},
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// reschedule brings the origins being probed in line with a config. Origins which are
+// unchanged keep their schedule, while others are stopped, started or restarted.
+func (s *scheduler) reschedule(cfg types.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Origins probed over both address families, or over both cold and warm connections,
+	// are scheduled once for each, and once from each source of the leaf
+	wanted := map[string]scheduledProbe{}
+	for _, origin := range cfg.Origins {
+		originID := origin.OriginID()
+		for _, source := range probeSources {
+			for _, family := range originFamilies(origin) {
+				if !source.probesFamily(family) {
+					continue
+				}
+				for _, connection := range originConnections(origin) {
+					key := fmt.Sprintf("%s/%s/%s/%s", originID, source.Name, family, connection)
+					wanted[key] = scheduledProbe{
+						origin: origin,
+						source: source,
+						labels: probeLabels{OriginID: originID, SourceID: leafID, Source: source.Name, IPFamily: family, Connection: connection},
+					}
+				}
+			}
+		}
+	}
+
+	for key, done := range s.stopping {
+		select {
+		case <-done:
+			delete(s.stopping, key)
+		default:
+		}
+	}
+
+	var started, stopped int
+	for key, scheduled := range s.scheduled {
+		probe, found := wanted[key]
+		if found && originConfig(probe.origin) == scheduled.config {
+			continue
+		}
+
+		// A probe under way finishes in the background, and forgets its series once it has
+		scheduled.cancel()
+		s.stopping[key] = scheduled.done
+		delete(s.scheduled, key)
+		stopped++
+	}
+
+	for key, probe := range wanted {
+		if _, found := s.scheduled[key]; found {
+			continue
+		}
+
+		p, found := probers[probe.origin.Type]
+		if !found {
+			err := terrors.InternalService("unknown_type", fmt.Sprintf("No prober for origin %s of type %s", probe.labels.OriginID, probe.origin.Type), nil)
+			slog.Error(s.ctx, "%+v", err)
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(withSource(s.ctx, probe.source))
+		done := make(chan struct{})
+		s.scheduled[key] = &scheduledOrigin{
+			config: originConfig(probe.origin),
+			cancel: cancel,
+			done:   done,
+		}
+
+		// An origin restarted with a changed config only starts once the probes it replaces
+		// have finished and forgotten the series, so that it starts afresh.
+		previous := s.stopping[key]
+		delete(s.stopping, key)
+
+		interval := time.Duration(probe.origin.Interval) * time.Second
+		offset := time.Duration(s.random.Int63n(int64(interval)))
+		go runOrigin(ctx, p, probe.origin, probe.labels, offset, previous, done)
+		started++
+	}
+
+	slog.Debug(s.ctx, "Scheduled %d probes, %d started and %d stopped", len(s.scheduled), started, stopped)
+}
+
+// runOrigin probes an origin every interval from the given offset, until its context is
+// cancelled. A probe which takes longer than the interval delays the next one rather than
+// overlapping with it. Probes only start once any previous probes of the series are done,
+// and the series is forgotten once the last probe has finished, before done is closed.
+func runOrigin(ctx context.Context, p prober, origin types.OriginEntry, labels probeLabels, offset time.Duration, previous <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	defer func() {
+		forgetSeries(labels)
+		deleteProbeMetrics(labels)
+	}()
+
+	if previous != nil {
+		<-previous
+	}
+
+	start := time.NewTimer(offset)
+	defer start.Stop()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-start.C:
+	}
+
+	ticker := time.NewTicker(time.Duration(origin.Interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		probeOrigin(ctx, p, origin, labels)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// forgetSeries drops what was remembered about a series of probes which has been stopped,
+// or about an address an origin no longer resolves to, so that it does not build up as
+// origins and their addresses come and go. Persistent connections of the series are closed.
+// It is only called once no probe of the series is under way, which would remember it again.
+func forgetSeries(labels probeLabels) {
+	originTokens.forget(labels)
+	originClocks.forget(labels)
+	originAddresses.forget(labels)
+	warmConnections.release(labels)
+}
+
+// seriesMatches returns whether a series of probes is the one given, or one of its addresses
+// or resolvers if no target address or resolver is given.
+func seriesMatches(series, labels probeLabels) bool {
+	if labels.TargetIP == "" {
+		series.TargetIP = ""
+	}
+	if labels.Resolver == "" {
+		series.Resolver = ""
+	}
+
+	return series == labels
+}
+
+// probeOrigin probes an origin once, or each of its addresses once if configured to.
+func probeOrigin(ctx context.Context, p prober, origin types.OriginEntry, labels probeLabels) {
+	if origin.ProbeAllAddresses {
+		probeAllAddresses(ctx, p, origin, labels)
+		return
+	}
+
+	probeOnce(ctx, p, origin, labels)
+}
+
+// probeOnce runs a single probe. A prober panicking is logged rather than taking down
+// probes of every other origin with it.
+func probeOnce(ctx context.Context, p prober, origin types.OriginEntry, labels probeLabels) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error(ctx, "Panic probing origin %s: %v\n%s", labels.OriginID, r, debug.Stack())
+		}
+	}()
+
+	if err := p.probe(ctx, origin, labels); err != nil {
+		slog.Debug(ctx, "Error probing origin %s: %v", labels.OriginID, err)
+	}
+}
+
+// originConfig serialises an origin as configured, so that origins can be compared.
+func originConfig(origin types.OriginEntry) string {
+	config, err := json.Marshal(origin)
+	if err != nil {
+		return ""
+	}
+
+	return string(config)
+}
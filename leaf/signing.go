@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+var (
+	// Key the leaf signs its probes with, for origins which only serve known leaves
+	leafSigner types.Signer
+
+	// Key responses of every advanced origin without its own must be signed with, if any
+	leafOriginKey types.Verifier
+)
+
+// originVerifier returns the key the responses of an origin must be signed with, which is
+// its own if set, or otherwise that of the leaf.
+func originVerifier(origin types.OriginEntry) types.Verifier {
+	if origin.OriginKey == "" {
+		return leafOriginKey
+	}
+
+	// Keys of origins are validated when the config is parsed
+	verifier, err := types.ParseVerifyKey(origin.OriginKey)
+	if err != nil {
+		return leafOriginKey
+	}
+
+	return verifier
+}
+
+// identifyProbe sets the headers which identify a probe to an origin, signing them if the
+// leaf has a key.
+func identifyProbe(req *typhon.Request, nonce string, leafTime int64) {
+	timestamp := strconv.FormatInt(leafTime, 10)
+	req.Header.Set(types.LeafIDHeader, leafID)
+	req.Header.Set(types.NonceHeader, nonce)
+	req.Header.Set(types.LeafTimeHeader, timestamp)
+	if leafSigner != nil {
+		req.Header.Set(types.LeafSignatureHeader, leafSigner.Sign(types.ProbeSigningMessage(leafID, nonce, timestamp)))
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+)
+
+// Lines sent to InfluxDB over UDP are packed into datagrams which fit in a typical MTU
+const influxDBMaxDatagram = 1400
+
+func validateInfluxDBSink(sink sinkConfig) (sinkConfig, error) {
+	u, err := url.Parse(sink.URL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp") {
+		return sink, terrors.BadRequest("invalid_sink", fmt.Sprintf("InfluxDB sink %s needs an http, https or udp url", sink.Name), nil)
+	}
+	if sink.Measurement == "" {
+		sink.Measurement = "oxcross_probe"
+	}
+	if sink.Timeout == 0 {
+		sink.Timeout = 10
+	}
+
+	return sink, nil
+}
+
+// newInfluxDBWriter returns a writer of probe results in the line protocol of InfluxDB,
+// either to its HTTP write endpoint, which accepts those of version 1 and 2, or over UDP.
+func newInfluxDBWriter(sink sinkConfig) (func(ctx context.Context, results []probeResult) error, error) {
+	u, _ := url.Parse(sink.URL)
+	if u.Scheme == "udp" {
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, terrors.Wrap(err, nil)
+		}
+
+		return func(ctx context.Context, results []probeResult) error {
+			lines := make([]string, 0, len(results))
+			for _, result := range results {
+				lines = append(lines, influxDBLine(sink.Measurement, result))
+			}
+			return writeDatagrams(conn, lines, influxDBMaxDatagram)
+		}, nil
+	}
+
+	timeout := time.Duration(sink.Timeout) * time.Second
+	return func(ctx context.Context, results []probeResult) error {
+		body := bytes.Buffer{}
+		for _, result := range results {
+			body.WriteString(influxDBLine(sink.Measurement, result))
+			body.WriteByte('\n')
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		req := typhon.NewRequest(ctx, http.MethodPost, sink.URL, nil)
+		req.ContentLength = int64(body.Len())
+		req.Body = ioutil.NopCloser(&body)
+		for header, value := range sink.Headers {
+			req.Header.Set(header, value)
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+		rsp := req.Send().Response()
+		if rsp.Error != nil || rsp.Response == nil {
+			return rsp.Error
+		}
+		rspBody, _ := rsp.BodyBytes(true)
+		if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+			return terrors.BadResponse("influxdb_failed", fmt.Sprintf("InfluxDB responded with status %d: %s", rsp.StatusCode, rspBody), nil)
+		}
+
+		return nil
+	}, nil
+}
+
+// influxDBLine formats a probe result in line protocol. The labels of the probe, the result
+// and any reason, status code and protocol are tags, while timings are fields in seconds.
+func influxDBLine(measurement string, result probeResult) string {
+	line := strings.Builder{}
+	line.WriteString(influxDBEscape(measurement, ", "))
+
+	tags := append(result.tags(), [2]string{"result", strconv.FormatBool(result.Result)})
+	if result.Reason != "" {
+		tags = append(tags, [2]string{"reason", result.Reason})
+	}
+	if result.StatusCode > 0 {
+		tags = append(tags, [2]string{"status_code", strconv.Itoa(result.StatusCode)})
+	}
+	if result.Protocol != "" {
+		tags = append(tags, [2]string{"protocol", result.Protocol})
+	}
+	for _, tag := range tags {
+		fmt.Fprintf(&line, ",%s=%s", influxDBEscape(tag[0], ",= "), influxDBEscape(tag[1], ",= "))
+	}
+
+	fmt.Fprintf(&line, " success=%t", result.Result)
+	for _, field := range resultTimings(result) {
+		fmt.Fprintf(&line, ",%s_seconds=%s", field.name, strconv.FormatFloat(field.value.Seconds(), 'f', -1, 64))
+	}
+
+	fmt.Fprintf(&line, " %d", result.Time.UnixNano())
+
+	return line.String()
+}
+
+// influxDBEscape escapes the characters given, which differ between measurements, and tag
+// keys and values.
+func influxDBEscape(s, special string) string {
+	if !strings.ContainsAny(s, special+"\\") {
+		return s
+	}
+
+	escaped := strings.Builder{}
+	for _, r := range s {
+		if strings.ContainsRune(special, r) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+
+	return escaped.String()
+}
+
+// resultTiming is the duration of a probe or one of its phases.
+type resultTiming struct {
+	name  string
+	value time.Duration
+}
+
+// resultTimings returns the duration of a probe and each of its phases, leaving out those
+// which did not take place.
+func resultTimings(result probeResult) []resultTiming {
+	timings := []resultTiming{
+		{"duration", result.Duration},
+		{"dns", result.Phases.DNS},
+		{"connect", result.Phases.Connect},
+		{"proxy", result.Phases.Proxy},
+		{"tls_handshake", result.Phases.TLS},
+		{"server", result.Phases.Server},
+		{"transfer", result.Phases.Transfer},
+	}
+
+	taken := []resultTiming{}
+	for _, timing := range timings {
+		if timing.value > 0 {
+			taken = append(taken, timing)
+		}
+	}
+
+	return taken
+}
+
+// writeDatagrams writes lines to a UDP socket, packing as many as fit in each datagram.
+func writeDatagrams(conn net.Conn, lines []string, maxSize int) error {
+	datagram := bytes.Buffer{}
+	flush := func() error {
+		if datagram.Len() == 0 {
+			return nil
+		}
+		_, err := conn.Write(datagram.Bytes())
+		datagram.Reset()
+		return err
+	}
+
+	for _, line := range lines {
+		if datagram.Len() > 0 && datagram.Len()+1+len(line) > maxSize {
+			if err := flush(); err != nil {
+				return terrors.Wrap(err, nil)
+			}
+		}
+		if datagram.Len() > 0 {
+			datagram.WriteByte('\n')
+		}
+		datagram.WriteString(line)
+	}
+
+	if err := flush(); err != nil {
+		return terrors.Wrap(err, nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Results formatted by the sink tests, with labels which need escaping and some left empty
+var (
+	testSucceededResult = probeResult{
+		Labels:     probeLabels{OriginID: "web 1,eu=x", SourceID: "leaf1", IPFamily: "any", Connection: "cold"},
+		Time:       time.Unix(1700000000, 5),
+		Result:     true,
+		StatusCode: 200,
+		Protocol:   "h2",
+		Duration:   150 * time.Millisecond,
+		Phases:     probePhases{DNS: 10 * time.Millisecond, Connect: 20 * time.Millisecond, TLS: 30500 * time.Microsecond},
+	}
+	testFailedResult = probeResult{
+		Labels:     probeLabels{OriginID: "api.example", SourceID: "leaf1", IPFamily: "ipv6", TargetIP: "2001:db8::1", Connection: "warm"},
+		Time:       time.Unix(1700000000, 0),
+		Reason:     "http_status_5xx",
+		StatusCode: 503,
+	}
+)
+
+func TestInfluxDBLine(t *testing.T) {
+	cases := []struct {
+		measurement string
+		result      probeResult
+		expected    string
+	}{
+		{
+			measurement: "oxcross probe,x",
+			result:      testSucceededResult,
+			expected:    `oxcross\ probe\,x,origin_id=web\ 1\,eu\=x,source_id=leaf1,ip_family=any,connection=cold,result=true,status_code=200,protocol=h2 success=true,duration_seconds=0.15,dns_seconds=0.01,connect_seconds=0.02,tls_handshake_seconds=0.0305 1700000000000000005`,
+		},
+		{
+			measurement: "oxcross=probe",
+			result:      testFailedResult,
+			expected:    `oxcross=probe,origin_id=api.example,source_id=leaf1,ip_family=ipv6,target_ip=2001:db8::1,connection=warm,result=false,reason=http_status_5xx,status_code=503 success=false 1700000000000000000`,
+		},
+	}
+
+	for _, c := range cases {
+		if line := influxDBLine(c.measurement, c.result); line != c.expected {
+			t.Errorf("expected\n%s\ngot\n%s", c.expected, line)
+		}
+	}
+}
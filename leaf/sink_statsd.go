@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/terrors"
+)
+
+// Metrics sent to StatsD are packed into datagrams which fit in a typical MTU, as the
+// DogStatsD client does
+const statsDMaxDatagram = 1432
+
+// Formats of StatsD metrics
+const (
+	statsDFormatDogStatsD = "dogstatsd" // Labels of probes are sent as tags
+	statsDFormatStatsD    = "statsd"    // Labels of probes are part of metric names
+)
+
+func validateStatsDSink(sink sinkConfig) (sinkConfig, error) {
+	if _, _, err := net.SplitHostPort(sink.URL); err != nil {
+		return sink, terrors.BadRequest("invalid_sink", fmt.Sprintf("StatsD sink %s needs a host:port url: %v", sink.Name, err), nil)
+	}
+	if sink.Prefix == "" {
+		sink.Prefix = "oxcross"
+	}
+	if sink.Format == "" {
+		sink.Format = statsDFormatDogStatsD
+	}
+	if sink.Format != statsDFormatDogStatsD && sink.Format != statsDFormatStatsD {
+		return sink, terrors.BadRequest("invalid_sink", fmt.Sprintf("Unsupported format %q of StatsD sink %s", sink.Format, sink.Name), nil)
+	}
+
+	return sink, nil
+}
+
+// newStatsDWriter returns a writer of probe results as StatsD metrics over UDP: a counter of
+// each result, and timers of the duration of successful probes and each of their phases.
+func newStatsDWriter(sink sinkConfig) (func(ctx context.Context, results []probeResult) error, error) {
+	conn, err := net.Dial("udp", sink.URL)
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	return func(ctx context.Context, results []probeResult) error {
+		lines := []string{}
+		for _, result := range results {
+			if sink.Format == statsDFormatStatsD {
+				lines = append(lines, statsDLines(sink.Prefix, result)...)
+			} else {
+				lines = append(lines, dogStatsDLines(sink.Prefix, result)...)
+			}
+		}
+		return writeDatagrams(conn, lines, statsDMaxDatagram)
+	}, nil
+}
+
+// dogStatsDLines formats a probe result as DogStatsD metrics, tagged with the labels of the
+// probe as in metrics. The counter of results is also tagged with the result, and any reason
+// and status code, while timers are tagged with any protocol.
+func dogStatsDLines(prefix string, result probeResult) []string {
+	tags := result.tags()
+	resultTags := append(tags[:len(tags):len(tags)], [2]string{"result", strconv.FormatBool(result.Result)})
+	if result.Reason != "" {
+		resultTags = append(resultTags, [2]string{"reason", result.Reason})
+	}
+	if result.StatusCode > 0 {
+		resultTags = append(resultTags, [2]string{"status_code", strconv.Itoa(result.StatusCode)})
+	}
+	if result.Protocol != "" {
+		tags = append(tags, [2]string{"protocol", result.Protocol})
+	}
+
+	lines := []string{fmt.Sprintf("%s.probe.result:1|c%s", prefix, dogStatsDTags(resultTags))}
+	for _, timing := range resultTimings(result) {
+		lines = append(lines, fmt.Sprintf("%s.probe.%s:%s|ms%s", prefix, timing.name, statsDMilliseconds(timing), dogStatsDTags(tags)))
+	}
+
+	return lines
+}
+
+func dogStatsDTags(tags [][2]string) string {
+	formatted := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		formatted = append(formatted, tag[0]+":"+statsDSanitise(tag[1], ",|#@"))
+	}
+
+	return "|#" + strings.Join(formatted, ",")
+}
+
+// statsDLines formats a probe result as plain StatsD metrics, which have no tags, so the
+// values of the labels of the probe are part of the names of metrics, in the same order as
+// in metrics and leaving out those which are empty. Results are counted by whether they
+// succeeded and why not.
+func statsDLines(prefix string, result probeResult) []string {
+	name := prefix
+	for _, tag := range result.tags() {
+		name += "." + statsDSanitise(tag[1], ".:|@#")
+	}
+
+	lines := []string{}
+	if result.Result {
+		lines = append(lines, name+".probe.success:1|c")
+	} else {
+		lines = append(lines, name+".probe.failure:1|c")
+		if result.Reason != "" {
+			lines = append(lines, fmt.Sprintf("%s.probe.failure.%s:1|c", name, statsDSanitise(result.Reason, ".:|@#")))
+		}
+	}
+	for _, timing := range resultTimings(result) {
+		lines = append(lines, fmt.Sprintf("%s.probe.%s:%s|ms", name, timing.name, statsDMilliseconds(timing)))
+	}
+
+	return lines
+}
+
+func statsDMilliseconds(timing resultTiming) string {
+	return strconv.FormatFloat(float64(timing.value.Microseconds())/1000, 'f', -1, 64)
+}
+
+// statsDSanitise replaces characters which would be misread in a metric, and whitespace.
+func statsDSanitise(s, special string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(special, r) || r == ' ' || r == '\n' {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStatsDLines(t *testing.T) {
+	cases := []struct {
+		result   probeResult
+		expected []string
+	}{
+		{
+			result: testSucceededResult,
+			expected: []string{
+				"oxcross.web_1,eu=x.leaf1.any.cold.probe.success:1|c",
+				"oxcross.web_1,eu=x.leaf1.any.cold.probe.duration:150|ms",
+				"oxcross.web_1,eu=x.leaf1.any.cold.probe.dns:10|ms",
+				"oxcross.web_1,eu=x.leaf1.any.cold.probe.connect:20|ms",
+				"oxcross.web_1,eu=x.leaf1.any.cold.probe.tls_handshake:30.5|ms",
+			},
+		},
+		{
+			// Every non-empty label is part of the name, so addresses of an origin are not
+			// counted together
+			result: testFailedResult,
+			expected: []string{
+				"oxcross.api_example.leaf1.ipv6.2001_db8__1.warm.probe.failure:1|c",
+				"oxcross.api_example.leaf1.ipv6.2001_db8__1.warm.probe.failure.http_status_5xx:1|c",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		lines := statsDLines("oxcross", c.result)
+		if strings.Join(lines, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("expected\n%s\ngot\n%s", strings.Join(c.expected, "\n"), strings.Join(lines, "\n"))
+		}
+	}
+}
+
+func TestDogStatsDLines(t *testing.T) {
+	cases := []struct {
+		result   probeResult
+		expected []string
+	}{
+		{
+			result: testSucceededResult,
+			expected: []string{
+				"oxcross.probe.result:1|c|#origin_id:web_1_eu=x,source_id:leaf1,ip_family:any,connection:cold,result:true,status_code:200",
+				"oxcross.probe.duration:150|ms|#origin_id:web_1_eu=x,source_id:leaf1,ip_family:any,connection:cold,protocol:h2",
+				"oxcross.probe.dns:10|ms|#origin_id:web_1_eu=x,source_id:leaf1,ip_family:any,connection:cold,protocol:h2",
+				"oxcross.probe.connect:20|ms|#origin_id:web_1_eu=x,source_id:leaf1,ip_family:any,connection:cold,protocol:h2",
+				"oxcross.probe.tls_handshake:30.5|ms|#origin_id:web_1_eu=x,source_id:leaf1,ip_family:any,connection:cold,protocol:h2",
+			},
+		},
+		{
+			result: testFailedResult,
+			expected: []string{
+				"oxcross.probe.result:1|c|#origin_id:api.example,source_id:leaf1,ip_family:ipv6,target_ip:2001:db8::1,connection:warm,result:false,reason:http_status_5xx,status_code:503",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		lines := dogStatsDLines("oxcross", c.result)
+		if strings.Join(lines, "\n") != strings.Join(c.expected, "\n") {
+			t.Errorf("expected\n%s\ngot\n%s", strings.Join(c.expected, "\n"), strings.Join(lines, "\n"))
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/monzo/terrors"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// probeSource is a source which probes are sent from, on leaves with several uplinks or
+// addresses. Probes are bound to its address, its network interface and its firewall mark,
+// whichever are set, so that one leaf can measure each of its uplinks separately.
+type probeSource struct {
+	Name      string `json:"name"`
+	IP        string `json:"ip"`
+	Interface string `json:"interface"` // Bound to with SO_BINDTODEVICE
+	Mark      int    `json:"fwmark"`    // Set with SO_MARK, for policy routing
+}
+
+// Sources of a leaf which probes are sent from, each probing every origin. By default
+// probes are sent from a single unnamed source, following the default route of the leaf.
+var probeSources = []probeSource{{}}
+
+var validSourceName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// parseProbeSources parses the sources of a leaf, as a JSON list.
+func parseProbeSources(config string) ([]probeSource, error) {
+	sources := []probeSource{}
+	if err := json.Unmarshal([]byte(config), &sources); err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+	if len(sources) == 0 {
+		return nil, terrors.BadRequest("invalid_source", "No sources configured", nil)
+	}
+
+	names := map[string]bool{}
+	for _, source := range sources {
+		switch {
+		case !validSourceName.MatchString(source.Name):
+			return nil, terrors.BadRequest("invalid_source", fmt.Sprintf("Invalid source name %q", source.Name), nil)
+		case names[source.Name]:
+			return nil, terrors.BadRequest("invalid_source", fmt.Sprintf("Duplicate source %s", source.Name), nil)
+		case source.IP != "" && net.ParseIP(source.IP) == nil:
+			return nil, terrors.BadRequest("invalid_source", fmt.Sprintf("Invalid IP address %s for source %s", source.IP, source.Name), nil)
+		case source.Mark < 0:
+			return nil, terrors.BadRequest("invalid_source", fmt.Sprintf("Invalid fwmark %d for source %s", source.Mark, source.Name), nil)
+		case source.IP == "" && source.Interface == "" && source.Mark == 0:
+			return nil, terrors.BadRequest("invalid_source", fmt.Sprintf("Source %s sets none of ip, interface or fwmark", source.Name), nil)
+		}
+		names[source.Name] = true
+	}
+
+	return sources, nil
+}
+
+// probesFamily returns whether probes over a family can be sent from the source, which is
+// not the case where the source address is of the other family.
+func (s probeSource) probesFamily(family string) bool {
+	ip := net.ParseIP(s.IP)
+	if ip == nil || (family != types.IPFamilyIPv4 && family != types.IPFamilyIPv6) {
+		return true
+	}
+
+	return ipFamily(ip) == family
+}
+
+type sourceKey struct{}
+
+// withSource makes sockets opened with the context bound to the given source.
+func withSource(ctx context.Context, source probeSource) context.Context {
+	if source == (probeSource{}) {
+		return ctx
+	}
+
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+func contextSource(ctx context.Context) probeSource {
+	source, _ := ctx.Value(sourceKey{}).(probeSource)
+	return source
+}
+
+// sourceDialer returns a copy of a dialer which binds to the source set in the context, or
+// the dialer itself if there is none. Connections over another family than that of the
+// source address are not attempted.
+func sourceDialer(ctx context.Context, dialer *net.Dialer, network string) *net.Dialer {
+	source := contextSource(ctx)
+	if source == (probeSource{}) {
+		return dialer
+	}
+
+	d := *dialer
+	if ip := net.ParseIP(source.IP); ip != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	d.Control = source.control(dialer.Control)
+
+	return &d
+}
+
+// sourceListenConfig returns the config and address to open sockets which are not
+// connected with, such as those of ICMP probes, bound to the source set in the context.
+func sourceListenConfig(ctx context.Context, lc net.ListenConfig, address string) (net.ListenConfig, string) {
+	source := contextSource(ctx)
+	if source == (probeSource{}) {
+		return lc, address
+	}
+
+	if source.IP != "" {
+		if _, port, err := net.SplitHostPort(address); err == nil {
+			address = net.JoinHostPort(source.IP, port)
+		} else {
+			address = source.IP
+		}
+	}
+	lc.Control = source.control(lc.Control)
+
+	return lc, address
+}
+
+// control binds sockets to the interface and firewall mark of the source, after applying
+// any other control of the sockets.
+func (s probeSource) control(next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if next != nil {
+			if err := next(network, address, c); err != nil {
+				return err
+			}
+		}
+
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = bindSocket(int(fd), s)
+		}); err != nil {
+			return err
+		}
+
+		return sockErr
+	}
+}
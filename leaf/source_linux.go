@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/monzo/terrors"
+	"golang.org/x/sys/unix"
+)
+
+// bindSocket binds a socket to the interface and firewall mark of a source. Setting the
+// mark requires CAP_NET_ADMIN, as does binding to an interface before Linux 5.7.
+func bindSocket(fd int, source probeSource) error {
+	if source.Interface != "" {
+		if err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, source.Interface); err != nil {
+			return terrors.Wrap(os.NewSyscallError("setsockopt", err), map[string]string{
+				"reason": reasonSocket,
+			})
+		}
+	}
+
+	if source.Mark != 0 {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_MARK, source.Mark); err != nil {
+			return terrors.Wrap(os.NewSyscallError("setsockopt", err), map[string]string{
+				"reason": reasonSocket,
+			})
+		}
+	}
+
+	return nil
+}
+
+// bindSocketAddress binds a socket opened without the net package to the address of a
+// source, if it has one.
+func bindSocketAddress(fd int, source probeSource, v6 bool) error {
+	ip := net.ParseIP(source.IP)
+	if ip == nil {
+		return nil
+	}
+
+	var sa unix.Sockaddr
+	if v6 {
+		addr := &unix.SockaddrInet6{}
+		copy(addr.Addr[:], ip.To16())
+		sa = addr
+	} else {
+		addr := &unix.SockaddrInet4{}
+		copy(addr.Addr[:], ip.To4())
+		sa = addr
+	}
+
+	if err := unix.Bind(fd, sa); err != nil {
+		return terrors.Wrap(os.NewSyscallError("bind", err), map[string]string{
+			"reason": reasonSocket,
+		})
+	}
+
+	return nil
+}
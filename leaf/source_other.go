@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/monzo/terrors"
+)
+
+// Binding to an interface or firewall mark relies on Linux socket options, and the leaf is
+// only built for Linux.
+func bindSocket(fd int, source probeSource) error {
+	if source.Interface == "" && source.Mark == 0 {
+		return nil
+	}
+
+	return terrors.InternalService("source_unsupported", "Binding to an interface or fwmark is only supported on Linux", map[string]string{
+		"reason": reasonSocket,
+	})
+}
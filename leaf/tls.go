@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsInspection summarises the certificate presented by an https origin and the session
+// negotiated with it. Session details are not available if the handshake failed.
+type tlsInspection struct {
+	ExpiryDays  float64
+	Issuer      string
+	Subject     string
+	Fingerprint string
+	SANMatch    bool
+	Verified    bool
+	Version     string
+	CipherSuite string
+	OCSPStapled bool
+}
+
+// inspectTLS builds an inspection from the outcome of a TLS handshake. The transport performs
+// the usual certificate verification, so a failed verification aborts the handshake and
+// the probe; in that case we recover the offending certificate from the verification error,
+// so that a leaf being presented with an unexpected certificate can still be observed.
+func inspectTLS(hostname string, state tls.ConnectionState, handshakeErr error) (*tlsInspection, bool) {
+	var leaf *x509.Certificate
+	if len(state.PeerCertificates) > 0 {
+		leaf = state.PeerCertificates[0]
+	}
+
+	inspection := &tlsInspection{}
+	if handshakeErr == nil {
+		inspection.Verified = true
+		inspection.Version = tlsVersionName(state.Version)
+		inspection.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		inspection.OCSPStapled = len(state.OCSPResponse) > 0
+	} else {
+		var unknownAuthorityErr x509.UnknownAuthorityError
+		var invalidErr x509.CertificateInvalidError
+		var hostnameErr x509.HostnameError
+		switch {
+		case errors.As(handshakeErr, &unknownAuthorityErr):
+			leaf = unknownAuthorityErr.Cert
+		case errors.As(handshakeErr, &invalidErr):
+			leaf = invalidErr.Cert
+		case errors.As(handshakeErr, &hostnameErr):
+			leaf = hostnameErr.Certificate
+		}
+	}
+
+	if leaf == nil {
+		return nil, false
+	}
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	inspection.ExpiryDays = time.Until(leaf.NotAfter).Hours() / 24
+	inspection.Issuer = leaf.Issuer.String()
+	inspection.Subject = leaf.Subject.String()
+	inspection.Fingerprint = hex.EncodeToString(fingerprint[:])
+	inspection.SANMatch = leaf.VerifyHostname(hostname) == nil
+
+	return inspection, true
+}
+
+func tlsVersionName(version uint16) string {
+	if name, found := tlsVersionNames[version]; found {
+		return name
+	}
+
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// probeTrace records when each phase of a single HTTP probe started and finished, through
+// the hooks provided by net/http/httptrace. Hooks can be called from goroutines owned by
+// the transport, so all access is guarded.
+type probeTrace struct {
+	mu sync.Mutex
+
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	proxyStart   time.Time
+	proxyDone    time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+
+	// The address connected to, which with dual stack dialing may be of either family
+	remoteAddr string
+
+	// Whether a connection was obtained, and whether it was a persistent one reused
+	gotConn bool
+	reused  bool
+
+	hasTLS   bool
+	tlsState tls.ConnectionState
+	tlsErr   error
+}
+
+// probePhases holds the durations of each phase of a completed probe. A phase which did not
+// take place (such as the TLS handshake of a plain HTTP probe) has a zero duration.
+type probePhases struct {
+	DNS      time.Duration
+	Connect  time.Duration
+	Proxy    time.Duration
+	TLS      time.Duration
+	Server   time.Duration
+	Transfer time.Duration
+}
+
+func newProbeTrace() *probeTrace {
+	return &probeTrace{}
+}
+
+type probeTraceKey struct{}
+
+// withContext traces connections dialled with the context, through both the hooks of
+// net/http/httptrace and those for phases it does not know about, such as proxy handshakes.
+func (t *probeTrace) withContext(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(context.WithValue(ctx, probeTraceKey{}, t), t.clientTrace())
+}
+
+// contextProbeTrace returns the trace of the probe a context belongs to, if it is traced.
+func contextProbeTrace(ctx context.Context) *probeTrace {
+	t, _ := ctx.Value(probeTraceKey{}).(*probeTrace)
+	return t
+}
+
+func (t *probeTrace) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsDone = time.Now()
+		},
+		ConnectStart: func(network, addr string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// With dual stack dialing several connections can be attempted, we time from the first.
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if err == nil && t.connectDone.IsZero() {
+				t.connectDone = time.Now()
+				t.remoteAddr = addr
+			}
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.gotConn = true
+			t.reused = info.Reused
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsDone = time.Now()
+			t.hasTLS = true
+			t.tlsState = state
+			t.tlsErr = err
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.firstByte = time.Now()
+		},
+	}
+}
+
+// proxyHandshakeStart records that a proxy was connected to, and asked to open a tunnel.
+func (t *probeTrace) proxyHandshakeStart() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.proxyStart = time.Now()
+}
+
+// proxyHandshakeDone records that a proxy opened a tunnel to the origin.
+func (t *probeTrace) proxyHandshakeDone() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.proxyDone = time.Now()
+}
+
+// connectedFamily returns the address family of the connection made, if any.
+func (t *probeTrace) connectedFamily() (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.remoteAddr == "" {
+		return "", false
+	}
+
+	return addrFamily(t.remoteAddr)
+}
+
+// newConnection returns whether the probe had to make a new connection, rather than reusing
+// a persistent one.
+func (t *probeTrace) newConnection() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.gotConn && !t.reused
+}
+
+// failureReason classifies the failure of a probe which received no response. Where the
+// error does not say what failed, such as when the probe timed out, the phase the probe had
+// reached does.
+func (t *probeTrace) failureReason(ctx context.Context, err error) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.tlsErr != nil {
+		if isVerificationError(t.tlsErr) {
+			return reasonTLSVerify
+		}
+		return reasonTLSHandshake
+	}
+
+	reason := classifyError(err)
+	if reason == reasonUnknown && ctx.Err() == context.DeadlineExceeded {
+		reason = reasonTimeout
+	}
+	if reason != reasonTimeout && reason != reasonUnknown {
+		return reason
+	}
+
+	timeout := reason == reasonTimeout
+	switch {
+	case !t.dnsStart.IsZero() && t.dnsDone.IsZero() && timeout:
+		return reasonDNSTimeout
+	case !t.dnsStart.IsZero() && t.dnsDone.IsZero():
+		return reasonDNSFailure
+	case !t.connectStart.IsZero() && t.connectDone.IsZero() && timeout:
+		return reasonConnectTimeout
+	case !t.connectStart.IsZero() && t.connectDone.IsZero():
+		return reasonConnectFailure
+	case !t.proxyStart.IsZero() && t.proxyDone.IsZero() && timeout:
+		return reasonProxyTimeout
+	case !t.proxyStart.IsZero() && t.proxyDone.IsZero():
+		return reasonProxyFailure
+	case !t.tlsStart.IsZero() && t.tlsDone.IsZero():
+		return reasonTLSHandshake
+	case !t.connectDone.IsZero() && timeout:
+		return reasonReadTimeout
+	case !t.connectDone.IsZero():
+		return reasonReadFailure
+	default:
+		return reason
+	}
+}
+
+// phases computes the duration of each phase, given the time at which the response body
+// had been fully read.
+func (t *probeTrace) phases(bodyDone time.Time) probePhases {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := probePhases{}
+	if !t.dnsStart.IsZero() && !t.dnsDone.IsZero() {
+		p.DNS = t.dnsDone.Sub(t.dnsStart)
+	}
+	if !t.connectStart.IsZero() && !t.connectDone.IsZero() {
+		p.Connect = t.connectDone.Sub(t.connectStart)
+	}
+	if !t.proxyStart.IsZero() && !t.proxyDone.IsZero() {
+		p.Proxy = t.proxyDone.Sub(t.proxyStart)
+	}
+	if !t.tlsStart.IsZero() && !t.tlsDone.IsZero() {
+		p.TLS = t.tlsDone.Sub(t.tlsStart)
+	}
+	if !t.wroteRequest.IsZero() && !t.firstByte.IsZero() {
+		p.Server = t.firstByte.Sub(t.wroteRequest)
+	}
+	if !t.firstByte.IsZero() && !bodyDone.IsZero() {
+		p.Transfer = bodyDone.Sub(t.firstByte)
+	}
+
+	return p
+}
+
+// exchangeTimes returns when the request finished being written and when the first byte of
+// the response arrived, if both happened.
+func (t *probeTrace) exchangeTimes() (time.Time, time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.wroteRequest, t.firstByte, !t.wroteRequest.IsZero() && !t.firstByte.IsZero()
+}
+
+// tlsInspection inspects the TLS session of the probe, returning false if no TLS handshake
+// was attempted or nothing could be learned about the certificate presented.
+func (t *probeTrace) tlsInspection(hostname string) (*tlsInspection, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.hasTLS {
+		return nil, false
+	}
+
+	return inspectTLS(hostname, t.tlsState, t.tlsErr)
+}
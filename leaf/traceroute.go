@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// We stop waiting for replies from hops this long after the probes are sent, or after
+// the probe timeout if that is shorter. Hops which have not replied by then are silent.
+const maxHopReplyWait = 3 * time.Second
+
+// hopReply is a reply to a probe sent with a particular TTL, either an ICMP error from a
+// router along the path, or a response from the target itself.
+type hopReply struct {
+	TTL         int
+	Address     net.IP
+	RTT         time.Duration
+	Reached     bool // The reply came from the target
+	Unreachable bool // A router reported the target to be unreachable
+}
+
+type tracerouteHop struct {
+	TTL     int     `json:"ttl"`
+	Address string  `json:"address,omitempty"` // Not set for hops which did not reply
+	RTT     float64 `json:"rtt_seconds,omitempty"`
+}
+
+// traceroutePath is the outcome of the latest traceroute to an origin.
+type traceroutePath struct {
+	OriginID    string          `json:"origin_id"`
+	IPFamily    string          `json:"ip_family"`
+	TargetIP    string          `json:"target_ip,omitempty"` // Only set when each address is traced separately
+	Protocol    string          `json:"protocol"`
+	Target      string          `json:"target"`
+	Reached     bool            `json:"reached"`
+	Fingerprint string          `json:"fingerprint"`
+	Hops        []tracerouteHop `json:"hops"`
+	Time        time.Time       `json:"time"`
+}
+
+// describe lists the hops of the path, with silent hops shown as in traceroute.
+func (p traceroutePath) describe() string {
+	hops := make([]string, 0, len(p.Hops))
+	for _, hop := range p.Hops {
+		if hop.Address == "" {
+			hops = append(hops, "*")
+			continue
+		}
+		hops = append(hops, hop.Address)
+	}
+
+	return strings.Join(hops, " > ")
+}
+
+// pathFingerprint identifies a path by the hops which replied to us. Silent hops are left
+// out, as routers often rate limit the errors they send, and would otherwise make the path
+// appear to change when it has not.
+func pathFingerprint(hops []tracerouteHop) string {
+	addresses := []string{}
+	for _, hop := range hops {
+		if hop.Address != "" {
+			addresses = append(addresses, hop.Address)
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(addresses, ",")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// pathStore holds the latest path traced to each origin over each address family, and to each
+// of its addresses if traced separately, to detect path changes and serve paths over HTTP.
+type pathStore struct {
+	mu    sync.RWMutex
+	paths map[string]traceroutePath
+}
+
+func (p traceroutePath) key() string {
+	return fmt.Sprintf("%s/%s/%s", p.OriginID, p.IPFamily, p.TargetIP)
+}
+
+var latestPaths = &pathStore{
+	paths: map[string]traceroutePath{},
+}
+
+// update stores the latest path to an origin, returning the path it replaces if any.
+func (s *pathStore) update(path traceroutePath) (traceroutePath, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, found := s.paths[path.key()]
+	s.paths[path.key()] = path
+
+	return previous, found
+}
+
+// list returns the latest paths to the given origin, or to every origin if not given.
+func (s *pathStore) list(originID string) []traceroutePath {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	paths := []traceroutePath{}
+	for _, path := range s.paths {
+		if originID == "" || path.OriginID == originID {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i].key() < paths[j].key()
+	})
+
+	return paths
+}
+
+// serveTraceroutePaths serves the latest path traced to each origin, or to the origin given
+// by the origin_id query parameter, over each family it is probed over.
+func serveTraceroutePaths(w http.ResponseWriter, r *http.Request) {
+	originID := r.URL.Query().Get("origin_id")
+	paths := latestPaths.list(originID)
+	if originID != "" && len(paths) == 0 {
+		http.Error(w, fmt.Sprintf("No path traced to origin %s", originID), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(paths); err != nil {
+		slog.Error(r.Context(), "Error serving traceroute paths: %v", err)
+	}
+}
+
+// tracerouteProber traces the path to origins by sending probes with increasing TTLs at
+// once, and recording the routers which report them expired in transit. Replies are read
+// from the socket error queue (IP_RECVERR), so no privileges are needed except for ICMP
+// probes where unprivileged ICMP sockets are not allowed.
+type tracerouteProber struct{}
+
+func newTracerouteProber() *tracerouteProber {
+	return &tracerouteProber{}
+}
+
+func (p *tracerouteProber) probe(ctx context.Context, origin types.OriginEntry, labels probeLabels) error {
+	ip, err := resolveProbeTarget(ctx, probeHost(origin, labels), labels.IPFamily)
+	if err != nil {
+		registerProbeResult(labels, false, classifyError(err))
+		slog.Error(ctx, "Error resolving %s: %v", origin.URL, err)
+		return err
+	}
+
+	wait := maxHopReplyWait
+	if timeout := probeTimeout(origin); timeout < wait {
+		wait = timeout
+	}
+
+	replies, err := traceHops(ctx, origin.Protocol, ip, origin.Port, origin.MaxHops, wait)
+	if err != nil {
+		registerProbeResult(labels, false, reasonSocket)
+		slog.Error(ctx, "Error tracing path to %s: %v", origin.URL, err)
+		return err
+	}
+
+	path := buildPath(replies)
+	path.OriginID = labels.OriginID
+	path.IPFamily = labels.IPFamily
+	path.TargetIP = labels.TargetIP
+	path.Protocol = origin.Protocol
+	path.Target = ip.String()
+
+	previous, found := latestPaths.update(path)
+	changed := found && previous.Fingerprint != path.Fingerprint
+	if changed {
+		slog.Warn(ctx, "Path to %s changed from %s (%s) to %s (%s)", origin.URL, previous.describe(), previous.Fingerprint, path.describe(), path.Fingerprint)
+	}
+	registerTraceroute(labels, path, previous, changed)
+
+	if !path.Reached {
+		registerProbeResult(labels, false, reasonNotReached)
+		slog.Error(ctx, "Traceroute to %s did not reach the origin within %d hops: %s", origin.URL, origin.MaxHops, path.describe())
+		return nil
+	}
+
+	rtt := time.Duration(path.Hops[len(path.Hops)-1].RTT * float64(time.Second))
+	registerProbeSuccess(labels, 0, "", rtt, probePhases{})
+
+	return nil
+}
+
+// buildPath orders replies into a path, which ends at the first hop to be the target or to
+// report it unreachable, or otherwise at the furthest hop which replied.
+func buildPath(replies []hopReply) traceroutePath {
+	sort.Slice(replies, func(i, j int) bool {
+		return replies[i].TTL < replies[j].TTL
+	})
+
+	byTTL := map[int]hopReply{}
+	last := 0
+	reached := false
+	for _, reply := range replies {
+		if _, found := byTTL[reply.TTL]; found {
+			continue
+		}
+		byTTL[reply.TTL] = reply
+		last = reply.TTL
+
+		if reply.Reached || reply.Unreachable {
+			reached = reply.Reached
+			break
+		}
+	}
+
+	path := traceroutePath{
+		Reached: reached,
+		Hops:    []tracerouteHop{},
+		Time:    time.Now(),
+	}
+	for ttl := 1; ttl <= last; ttl++ {
+		hop := tracerouteHop{
+			TTL: ttl,
+		}
+		if reply, found := byTTL[ttl]; found {
+			hop.Address = reply.Address.String()
+			hop.RTT = reply.RTT.Seconds()
+		}
+		path.Hops = append(path.Hops, hop)
+	}
+	path.Fingerprint = pathFingerprint(path.Hops)
+
+	return path
+}
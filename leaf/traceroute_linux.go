@@ -0,0 +1,423 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/monzo/terrors"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// ICMP types and codes reported in the socket error queue
+const (
+	icmpTimeExceeded       = 11
+	icmpDestUnreachable    = 3
+	icmpPortUnreachable    = 3
+	icmpv6TimeExceeded     = 3
+	icmpv6DestUnreachable  = 1
+	icmpv6PortUnreachable  = 4
+	sockExtendedErrSize    = 16
+	tracerouteMaxReplySize = 1500
+)
+
+// traceHops sends a probe for each TTL up to maxHops, and collects replies until wait has
+// passed or every TTL up to the target has replied.
+func traceHops(ctx context.Context, protocol string, target net.IP, port, maxHops int, wait time.Duration) ([]hopReply, error) {
+	if protocol == types.TracerouteProtocolTCP {
+		return traceTCP(ctx, target, port, maxHops, wait), nil
+	}
+
+	return traceDatagram(ctx, protocol, target, port, maxHops, wait)
+}
+
+// traceDatagram traces with UDP datagrams or ICMP echo requests sent from a single socket.
+// Probes are told apart in errors by their payload, which is the TTL for UDP, and by the
+// sequence number of echo requests.
+func traceDatagram(ctx context.Context, protocol string, target net.IP, port, maxHops int, wait time.Duration) ([]hopReply, error) {
+	v6 := target.To4() == nil
+
+	var conn net.PacketConn
+	var raw bool
+	var err error
+	if protocol == types.TracerouteProtocolICMP {
+		conn, raw, err = listenICMP(ctx, v6, false)
+	} else {
+		network := "udp4"
+		if v6 {
+			network = "udp6"
+		}
+		lc, address := sourceListenConfig(ctx, net.ListenConfig{}, ":0")
+		conn, err = lc.ListenPacket(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, terrors.InternalService("traceroute_socket", "Socket does not support socket options", nil)
+	}
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	// On raw sockets, which receive all ICMP traffic of the host, the identifier of echo
+	// replies is checked too
+	idBytes := make([]byte, 2)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+	id := int(binary.BigEndian.Uint16(idBytes))
+
+	sendTimes := make([]time.Time, maxHops+1)
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		var sockErr error
+		if err := rawConn.Control(func(fd uintptr) {
+			sockErr = setTraceSocketOptions(int(fd), v6, ttl)
+		}); err != nil {
+			return nil, terrors.Wrap(err, nil)
+		}
+		if sockErr != nil {
+			return nil, terrors.Wrap(sockErr, nil)
+		}
+
+		var packet []byte
+		var dst net.Addr
+		if protocol == types.TracerouteProtocolICMP {
+			packet, err = echoRequest(v6, id, ttl, nil)
+			if err != nil {
+				return nil, terrors.Wrap(err, nil)
+			}
+			dst = icmpDestination(target, raw)
+		} else {
+			packet = []byte{byte(ttl)}
+			dst = &net.UDPAddr{IP: target, Port: port + ttl - 1}
+		}
+
+		// A probe which cannot be sent leaves its hop silent
+		sendTimes[ttl] = time.Now()
+		conn.WriteTo(packet, dst)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(wait))
+
+	replies := []hopReply{}
+	answered := map[int]bool{}
+	reachedTTL := 0
+	buf := make([]byte, tracerouteMaxReplySize)
+	oob := make([]byte, 512)
+	for {
+		var reply hopReply
+		var found bool
+		err := rawConn.Read(func(fd uintptr) bool {
+			var done bool
+			reply, found, done = readTraceReply(int(fd), protocol, v6, raw, id, maxHops, buf, oob)
+			return done
+		})
+		if err != nil {
+			// The deadline has passed
+			break
+		}
+		if !found || answered[reply.TTL] {
+			continue
+		}
+
+		reply.RTT = time.Since(sendTimes[reply.TTL])
+		replies = append(replies, reply)
+		answered[reply.TTL] = true
+		if (reply.Reached || reply.Unreachable) && (reachedTTL == 0 || reply.TTL < reachedTTL) {
+			reachedTTL = reply.TTL
+		}
+
+		if reachedTTL > 0 && allAnswered(answered, reachedTTL) {
+			break
+		}
+	}
+
+	return replies, nil
+}
+
+func allAnswered(answered map[int]bool, upTo int) bool {
+	for ttl := 1; ttl <= upTo; ttl++ {
+		if !answered[ttl] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// readTraceReply reads a reply to a probe from either the socket error queue or, for echo
+// replies, the socket itself. It returns whether a reply was found, and whether the read
+// should be retried immediately rather than once the socket is ready.
+func readTraceReply(fd int, protocol string, v6, raw bool, id, maxHops int, buf, oob []byte) (hopReply, bool, bool) {
+	n, oobn, _, _, err := unix.Recvmsg(fd, buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	if err == nil {
+		reply, found := parseHopError(buf[:n], oob[:oobn], protocol, v6, raw, id, maxHops)
+		return reply, found, true
+	}
+
+	n, _, _, from, err := unix.Recvmsg(fd, buf, nil, unix.MSG_DONTWAIT)
+	switch {
+	case err == unix.EAGAIN:
+		return hopReply{}, false, false
+	case err != nil:
+		// Errors pending on the socket are returned once, and are also in the error queue
+		return hopReply{}, false, true
+	case protocol != types.TracerouteProtocolICMP:
+		return hopReply{}, false, true
+	}
+
+	payload := buf[:n]
+	if raw && !v6 && n > 0 {
+		// Raw IPv4 sockets receive the IP header too
+		headerLen := int(payload[0]&0x0f) << 2
+		if headerLen > n {
+			return hopReply{}, false, true
+		}
+		payload = payload[headerLen:]
+	}
+
+	protocolNumber := protocolICMP
+	var replyType icmp.Type = ipv4.ICMPTypeEchoReply
+	if v6 {
+		protocolNumber = protocolICMPv6
+		replyType = ipv6.ICMPTypeEchoReply
+	}
+
+	message, err := icmp.ParseMessage(protocolNumber, payload)
+	if err != nil || message.Type != replyType {
+		return hopReply{}, false, true
+	}
+	echo, ok := message.Body.(*icmp.Echo)
+	if !ok || (raw && echo.ID != id) || echo.Seq < 1 || echo.Seq > maxHops {
+		return hopReply{}, false, true
+	}
+
+	return hopReply{
+		TTL:     echo.Seq,
+		Address: sockaddrIP(from),
+		Reached: true,
+	}, true, true
+}
+
+// parseHopError parses an ICMP error from the socket error queue, which comes with the
+// payload of the probe it was sent in response to.
+func parseHopError(payload, oob []byte, protocol string, v6, raw bool, id, maxHops int) (hopReply, bool) {
+	reply, found := parseErrQueueMessage(oob, v6)
+	if !found {
+		return hopReply{}, false
+	}
+
+	switch protocol {
+	case types.TracerouteProtocolICMP:
+		// The echo request sent, from its ICMP header
+		if len(payload) < 8 || (raw && int(binary.BigEndian.Uint16(payload[4:6])) != id) {
+			return hopReply{}, false
+		}
+		reply.TTL = int(binary.BigEndian.Uint16(payload[6:8]))
+	case types.TracerouteProtocolUDP:
+		if len(payload) < 1 {
+			return hopReply{}, false
+		}
+		reply.TTL = int(payload[0])
+	}
+
+	if reply.TTL < 1 || reply.TTL > maxHops {
+		return hopReply{}, false
+	}
+
+	return reply, true
+}
+
+// parseErrQueueMessage finds the ICMP error among the control messages read from the socket
+// error queue.
+func parseErrQueueMessage(oob []byte, v6 bool) (hopReply, bool) {
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return hopReply{}, false
+	}
+
+	for _, message := range messages {
+		isV4Err := message.Header.Level == unix.IPPROTO_IP && message.Header.Type == unix.IP_RECVERR
+		isV6Err := message.Header.Level == unix.IPPROTO_IPV6 && message.Header.Type == unix.IPV6_RECVERR
+		if !isV4Err && !isV6Err {
+			continue
+		}
+
+		if reply, found := parseSockExtendedErr(message.Data, v6); found {
+			return reply, true
+		}
+	}
+
+	return hopReply{}, false
+}
+
+// parseSockExtendedErr parses a struct sock_extended_err, followed by the address of the
+// router which sent the error.
+func parseSockExtendedErr(data []byte, v6 bool) (hopReply, bool) {
+	addressOffset, addressLen := sockExtendedErrSize+4, net.IPv4len
+	if v6 {
+		addressOffset, addressLen = sockExtendedErrSize+8, net.IPv6len
+	}
+	if len(data) < addressOffset+addressLen {
+		return hopReply{}, false
+	}
+
+	origin, icmpType, icmpCode := data[4], data[5], data[6]
+	if origin != unix.SO_EE_ORIGIN_ICMP && origin != unix.SO_EE_ORIGIN_ICMP6 {
+		return hopReply{}, false
+	}
+
+	reply := hopReply{
+		Address: net.IP(append([]byte{}, data[addressOffset:addressOffset+addressLen]...)),
+	}
+	switch {
+	case !v6 && icmpType == icmpTimeExceeded, v6 && icmpType == icmpv6TimeExceeded:
+	case !v6 && icmpType == icmpDestUnreachable && icmpCode == icmpPortUnreachable,
+		v6 && icmpType == icmpv6DestUnreachable && icmpCode == icmpv6PortUnreachable:
+		// Only the target responds to UDP probes with port unreachable
+		reply.Reached = true
+	case !v6 && icmpType == icmpDestUnreachable, v6 && icmpType == icmpv6DestUnreachable:
+		reply.Unreachable = true
+	default:
+		return hopReply{}, false
+	}
+
+	return reply, true
+}
+
+// traceTCP traces by attempting a TCP connection for each TTL. A connection accepted or
+// refused has reached the target, while a SYN expiring in transit is reported in the error
+// queue of its socket, which we keep a duplicate descriptor of to read once the connection
+// has failed.
+func traceTCP(ctx context.Context, target net.IP, port, maxHops int, wait time.Duration) []hopReply {
+	v6 := target.To4() == nil
+	address := net.JoinHostPort(target.String(), strconv.Itoa(port))
+
+	var mu sync.Mutex
+	replies := []hopReply{}
+
+	var wg sync.WaitGroup
+	for ttl := 1; ttl <= maxHops; ttl++ {
+		ttl := ttl // Avoids shadowing
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reply, found := traceTCPHop(ctx, address, v6, ttl, wait)
+			if !found {
+				return
+			}
+
+			mu.Lock()
+			replies = append(replies, reply)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return replies
+}
+
+func traceTCPHop(ctx context.Context, address string, v6 bool, ttl int, wait time.Duration) (hopReply, bool) {
+	errFd := -1
+	dialer := &net.Dialer{
+		Timeout:   wait,
+		KeepAlive: -1 * time.Second, // Disabled
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				if sockErr = setTraceSocketOptions(int(fd), v6, ttl); sockErr != nil {
+					return
+				}
+				errFd, sockErr = unix.Dup(int(fd))
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+
+	start := time.Now()
+	conn, err := sourceDialer(ctx, dialer, "tcp").DialContext(ctx, "tcp", address)
+	rtt := time.Since(start)
+	if errFd >= 0 {
+		defer unix.Close(errFd)
+	}
+
+	switch {
+	case err == nil, errors.Is(err, syscall.ECONNREFUSED):
+		if conn != nil {
+			conn.Close()
+		}
+		host, _, _ := net.SplitHostPort(address)
+		return hopReply{
+			TTL:     ttl,
+			Address: net.ParseIP(host),
+			RTT:     rtt,
+			Reached: true,
+		}, true
+	case errFd < 0:
+		return hopReply{}, false
+	}
+
+	buf := make([]byte, tracerouteMaxReplySize)
+	oob := make([]byte, 512)
+	_, oobn, _, _, err := unix.Recvmsg(errFd, buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	if err != nil {
+		return hopReply{}, false
+	}
+
+	reply, found := parseErrQueueMessage(oob[:oobn], v6)
+	if !found {
+		return hopReply{}, false
+	}
+	reply.TTL = ttl
+	reply.RTT = rtt
+
+	return reply, true
+}
+
+// setTraceSocketOptions enables the error queue of a socket, and sets the TTL or hop limit
+// of packets it sends.
+func setTraceSocketOptions(fd int, v6 bool, ttl int) error {
+	level, recvErr, ttlOption := unix.IPPROTO_IP, unix.IP_RECVERR, unix.IP_TTL
+	if v6 {
+		level, recvErr, ttlOption = unix.IPPROTO_IPV6, unix.IPV6_RECVERR, unix.IPV6_UNICAST_HOPS
+	}
+
+	if err := unix.SetsockoptInt(fd, level, recvErr, 1); err != nil {
+		return err
+	}
+
+	return unix.SetsockoptInt(fd, level, ttlOption, ttl)
+}
+
+func sockaddrIP(sa unix.Sockaddr) net.IP {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(append([]byte{}, addr.Addr[:]...))
+	case *unix.SockaddrInet6:
+		return net.IP(append([]byte{}, addr.Addr[:]...))
+	default:
+		return nil
+	}
+}
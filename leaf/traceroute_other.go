@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/monzo/terrors"
+)
+
+// Traceroutes rely on the Linux socket error queue to receive ICMP errors unprivileged.
+func traceHops(ctx context.Context, protocol string, target net.IP, port, maxHops int, wait time.Duration) ([]hopReply, error) {
+	return nil, terrors.InternalService("traceroute_unsupported", "Traceroutes are only supported on Linux", nil)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// originConnections returns the connections an HTTP origin is probed over, one probe each.
+// Other types of origins do not keep connections, and are probed once.
+func originConnections(origin types.OriginEntry) []string {
+	switch origin.ConnectionMode {
+	case types.ConnectionModeCold, types.ConnectionModeWarm:
+		return []string{origin.ConnectionMode}
+	case types.ConnectionModeBoth:
+		return []string{types.ConnectionModeCold, types.ConnectionModeWarm}
+	default:
+		return []string{""}
+	}
+}
+
+// warmPool holds a transport for each series of warm probes, so that each keeps its own
+// persistent connection, including to each address of origins probing all of them.
+type warmPool struct {
+	mu          sync.Mutex
+	connections map[string]*warmConnection
+}
+
+// warmConnection is a transport keeping a single persistent connection to an origin.
+type warmConnection struct {
+	labels    probeLabels
+	transport probeTransport
+	client    typhon.Service
+	connected bool // A connection has been made before, so a new one is a reconnection
+}
+
+var warmConnections = &warmPool{
+	connections: map[string]*warmConnection{},
+}
+
+// get returns the persistent connection for a series of warm probes, creating it with the
+// given protocol if this is the first probe. Idle connections are kept open for as long as
+// the origin and anything in between allow, as their closing it is what we want to find
+// out about.
+func (p *warmPool) get(labels probeLabels, protocol string) *warmConnection {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := strings.Join(labels.values(), "/")
+	if conn, found := p.connections[key]; found {
+		return conn
+	}
+
+	transport := newProbeTransport(labels.IPFamily, protocol, true)
+	conn := &warmConnection{
+		labels:    labels,
+		transport: transport,
+		client:    newProbeClient(transport),
+	}
+	p.connections[key] = conn
+
+	return conn
+}
+
+// reconnected records whether a warm probe made a new connection, returning whether it
+// replaced one made before.
+func (c *warmConnection) reconnected(newConnection bool) bool {
+	if !newConnection {
+		return false
+	}
+
+	reconnected := c.connected
+	c.connected = true
+
+	return reconnected
+}
+
+// release closes the persistent connections of a series of probes, over each of its
+// addresses if probed separately unless a target address is given.
+func (p *warmPool) release(labels probeLabels) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conn := range p.connections {
+		if !seriesMatches(conn.labels, labels) {
+			continue
+		}
+
+		conn.transport.CloseIdleConnections()
+		delete(p.connections, key)
+	}
+}
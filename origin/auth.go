@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// Key the origin signs its responses with, if any
+var responseSigner types.Signer
+
+// Keys of the leaves allowed to probe the origin, by leaf ID, with a key for any leaf under
+// anyLeaf. Any leaf may probe the origin if none are set.
+var leafKeys map[string]types.Verifier
+
+const anyLeaf = "*"
+
+const (
+	// Nonces of accepted probes are remembered for this long after they were received.
+	nonceWindow = 5 * time.Minute
+
+	// Nonces seen beyond this many within the window are not remembered, and their probes
+	// are rejected, so that a leaf cannot exhaust memory.
+	maxRecentNonces = 65536
+)
+
+// If set, probes sent further than this from the time of the origin are rejected, so that a
+// probe captured on the way cannot be replayed once its nonce is forgotten. This relies on
+// the clocks of leaves, so is off by default, as leaves measure the drift of origin clocks
+// exactly when theirs are off.
+var maxLeafTimeSkew time.Duration
+
+// Nonces of probes accepted within the window, which are rejected if seen again
+var recentNonces = newNonceSet(nonceWindow, maxRecentNonces)
+
+// nonceSet remembers nonces for a window after they were received.
+type nonceSet struct {
+	window time.Duration
+	limit  int
+
+	mu        sync.Mutex
+	seen      map[string]time.Time // Until when each nonce is remembered
+	lastSweep time.Time
+}
+
+func newNonceSet(window time.Duration, limit int) *nonceSet {
+	return &nonceSet{
+		window: window,
+		limit:  limit,
+		seen:   map[string]time.Time{},
+	}
+}
+
+// add remembers a nonce received now, returning false if it was seen before or no more can
+// be remembered.
+func (s *nonceSet) add(nonce string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.seen) >= s.limit || now.Sub(s.lastSweep) >= time.Second {
+		s.sweep(now)
+	}
+
+	if _, found := s.seen[nonce]; found || len(s.seen) >= s.limit {
+		return false
+	}
+	s.seen[nonce] = now.Add(s.window)
+
+	return true
+}
+
+// sweep forgets nonces received longer than the window ago.
+func (s *nonceSet) sweep(now time.Time) {
+	s.lastSweep = now
+	for nonce, expiry := range s.seen {
+		if now.After(expiry) {
+			delete(s.seen, nonce)
+		}
+	}
+}
+
+// parseLeafKeys parses the keys of leaves allowed to probe the origin, as a JSON object.
+func parseLeafKeys(config string) (map[string]types.Verifier, error) {
+	keys := map[string]string{}
+	if err := json.Unmarshal([]byte(config), &keys); err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+	if len(keys) == 0 {
+		return nil, terrors.BadRequest("invalid_key", "No leaf keys configured", nil)
+	}
+
+	verifiers := map[string]types.Verifier{}
+	for leaf, key := range keys {
+		verifier, err := types.ParseVerifyKey(key)
+		if err != nil {
+			return nil, terrors.BadRequest("invalid_key", fmt.Sprintf("Invalid key for leaf %s: %v", leaf, err), nil)
+		}
+		verifiers[leaf] = verifier
+	}
+
+	return verifiers, nil
+}
+
+// requireLeaf rejects probes which are not signed by a known leaf, if leaves are required
+// to sign their probes.
+func requireLeaf(svc typhon.Service) typhon.Service {
+	return func(req typhon.Request) typhon.Response {
+		if leafKeys == nil {
+			return svc(req)
+		}
+
+		leaf := req.Header.Get(types.LeafIDHeader)
+		verifier, found := leafKeys[leaf]
+		if !found {
+			verifier, found = leafKeys[anyLeaf]
+		}
+		if !found || leaf == "" {
+			return typhon.Response{Error: terrors.Forbidden("unknown_leaf", fmt.Sprintf("Leaf %q is not allowed to probe this origin", leaf), nil)}
+		}
+
+		message := types.ProbeSigningMessage(leaf, req.Header.Get(types.NonceHeader), req.Header.Get(types.LeafTimeHeader))
+		if !verifier.Verify(message, req.Header.Get(types.LeafSignatureHeader)) {
+			return typhon.Response{Error: terrors.Unauthorized("signature_invalid", fmt.Sprintf("Probe from leaf %s is not signed with its key", leaf), nil)}
+		}
+
+		// A signed probe could otherwise be replayed by anything which saw it
+		now := time.Now()
+		if maxLeafTimeSkew > 0 {
+			leafTime, err := strconv.ParseInt(req.Header.Get(types.LeafTimeHeader), 10, 64)
+			sent := time.Unix(0, leafTime)
+			if err != nil || sent.Before(now.Add(-maxLeafTimeSkew)) || sent.After(now.Add(maxLeafTimeSkew)) {
+				return typhon.Response{Error: terrors.Unauthorized(types.StaleProbeCode, fmt.Sprintf("Probe from leaf %s was not sent within %v of now", leaf, maxLeafTimeSkew), nil)}
+			}
+		}
+
+		nonce := req.Header.Get(types.NonceHeader)
+		if nonce == "" || !recentNonces.add(leaf+"/"+nonce, now) {
+			return typhon.Response{Error: terrors.Unauthorized("replayed_probe", fmt.Sprintf("Probe from leaf %s repeats a recent nonce, or too many were seen to remember it", leaf), nil)}
+		}
+
+		return svc(req)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/monzo/slog"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+const (
+	// Replies per second to each source, and to all sources together, by default
+	defaultEchoSourceRate = 100
+	defaultEchoTotalRate  = 2000
+
+	// Sources beyond this many which have been replied to recently are not replied to,
+	// so that spoofing many sources cannot exhaust memory
+	maxEchoSources = 4096
+)
+
+// echoBucket is a token bucket of replies, refilled at a constant rate up to its burst.
+type echoBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *echoBucket) take(now time.Time, rate, burst float64) bool {
+	b.tokens += now.Sub(b.updated).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.updated = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// echoLimiter limits how fast the echo responder replies to each source address, and to
+// all of them together, so that it cannot be used to flood a spoofed source with replies.
+// Each source may burst up to the largest burst a leaf sends.
+type echoLimiter struct {
+	sourceRate float64
+	totalRate  float64
+
+	total     echoBucket
+	sources   map[string]*echoBucket
+	lastSweep time.Time
+}
+
+func newEchoLimiter(sourceRate, totalRate float64) *echoLimiter {
+	now := time.Now()
+	return &echoLimiter{
+		sourceRate: sourceRate,
+		totalRate:  totalRate,
+		total:      echoBucket{tokens: totalRate, updated: now},
+		sources:    map[string]*echoBucket{},
+		lastSweep:  now,
+	}
+}
+
+func (l *echoLimiter) allow(addr net.Addr) bool {
+	now := time.Now()
+	l.sweep(now)
+
+	source := addr.String()
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		source = udpAddr.IP.String()
+	}
+
+	bucket, found := l.sources[source]
+	if !found {
+		if len(l.sources) >= maxEchoSources {
+			return false
+		}
+		bucket = &echoBucket{tokens: types.EchoMaxBurst, updated: now}
+		l.sources[source] = bucket
+	}
+
+	if !bucket.take(now, l.sourceRate, types.EchoMaxBurst) {
+		return false
+	}
+
+	return l.total.take(now, l.totalRate, l.totalRate)
+}
+
+// sweep forgets sources whose buckets have refilled, which are no different from sources
+// never seen.
+func (l *echoLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < 10*time.Second {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(types.EchoMaxBurst / l.sourceRate * float64(time.Second))
+	for source, bucket := range l.sources {
+		if now.Sub(bucket.updated) >= refill {
+			delete(l.sources, source)
+		}
+	}
+}
+
+// serveEcho echoes valid probe datagrams back to their sender until the connection is closed,
+// within the limits on replies.
+func serveEcho(ctx context.Context, conn net.PacketConn, limiter *echoLimiter) {
+	buf := make([]byte, types.EchoMaxPacketSize+1)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			slog.Info(ctx, "Echo responder stopped: %v", err)
+			return
+		}
+
+		if n < types.EchoHeaderSize || n > types.EchoMaxPacketSize || !bytes.HasPrefix(buf[:n], []byte(types.EchoMagic)) {
+			continue
+		}
+
+		if !limiter.allow(addr) {
+			continue
+		}
+
+		if _, err := conn.WriteTo(buf[:n], addr); err != nil {
+			slog.Warn(ctx, "Error echoing datagram to %v: %v", addr, err)
+		}
+	}
+}
+
+func listenEcho(ctx context.Context, port int, limiter *echoLimiter) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+
+	go serveEcho(ctx, conn, limiter)
+
+	return conn, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+func TestListenEcho(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Replies to all sources together are limited to a burst of 5
+	conn, err := listenEcho(ctx, 0, newEchoLimiter(1, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+
+	// Datagrams which are not probes are never echoed
+	invalid := [][]byte{
+		[]byte(types.EchoMagic),
+		bytes.Repeat([]byte("x"), types.EchoHeaderSize),
+		append([]byte(types.EchoMagic), make([]byte, types.EchoMaxPacketSize)...),
+	}
+	for _, datagram := range invalid {
+		if _, err := client.WriteTo(datagram, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sent := map[string]bool{}
+	for seq := 0; seq < 10; seq++ {
+		datagram := []byte(fmt.Sprintf("%s%-20d", types.EchoMagic, seq))
+		sent[string(datagram)] = true
+		if _, err := client.WriteTo(datagram, server); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replies := 0
+	buf := make([]byte, types.EchoMaxPacketSize+1)
+	for {
+		client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if !sent[string(buf[:n])] {
+			t.Errorf("unexpected reply %q", buf[:n])
+		}
+		replies++
+	}
+
+	if replies != 5 {
+		t.Errorf("expected 5 replies within the limit, got %d", replies)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/monzo/slog"
+	"github.com/monzo/typhon"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listenHTTP3 serves the same endpoints as the HTTP server over HTTP/3, for leaves probing
+// with the h3 protocol. QUIC always uses TLS, so a certificate and its key are needed.
+func listenHTTP3(ctx context.Context, svc typhon.Service, port int, certFile, keyFile string) (*http3.Server, net.PacketConn, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	srv := &http3.Server{
+		Handler:   typhon.HttpHandler(svc),
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	}
+
+	go func() {
+		if err := srv.Serve(conn); err != nil && err != http.ErrServerClosed {
+			slog.Error(ctx, "HTTP/3 server stopped: %v", err)
+		}
+	}()
+
+	return srv, conn, nil
+}
@@ -21,8 +21,12 @@ import (
 // Simple typhon server responding to polls from clients
 func service() typhon.Service {
 	router := typhon.Router{}
-	router.GET("/oxcross", serveResponse)
+	router.GET("/oxcross", requireLeaf(serveResponse))
 	router.GET("/healthz", serveResponse)
+	if serveThroughput {
+		router.GET(types.ThroughputDownloadPath, requireLeaf(serveDownload))
+		router.POST(types.ThroughputUploadPath, requireLeaf(serveUpload))
+	}
 
 	svc := router.Serve().Filter(typhon.ErrorFilter).Filter(typhon.H2cFilter)
 
@@ -30,7 +34,8 @@ func service() typhon.Service {
 }
 
 func serveResponse(req typhon.Request) typhon.Response {
-	serverTime := time.Now().Format(time.RFC3339)
+	received := time.Now()
+	serverTime := received.Format(time.RFC3339)
 
 	entropy := make([]byte, 24)
 	rand.Read(entropy) // Best effort
@@ -40,6 +45,18 @@ func serveResponse(req typhon.Request) typhon.Response {
 	rsp := types.OriginResponse{
 		ServerTime: serverTime,
 		Token:      token,
+		Nonce:      req.Header.Get(types.NonceHeader),
+	}
+
+	// Timestamps are only of use to leaves which sent theirs
+	if leafTime, err := strconv.ParseInt(req.Header.Get(types.LeafTimeHeader), 10, 64); err == nil {
+		rsp.LeafTime = leafTime
+		rsp.ReceiveTime = received.UnixNano()
+		rsp.TransmitTime = time.Now().UnixNano()
+	}
+
+	if responseSigner != nil {
+		rsp.Signature = responseSigner.Sign(rsp.SigningMessage())
 	}
 
 	return req.Response(&rsp)
@@ -59,6 +76,66 @@ func main() {
 		port = int(portNum)
 	}
 
+	// Sign responses, so that leaves can tell them apart from those of anything impersonating
+	// the origin, such as a captive portal.
+	if os.Getenv("OXCROSS_ORIGIN_SIGNING_KEY") != "" {
+		signer, err := types.ParseSigningKey(os.Getenv("OXCROSS_ORIGIN_SIGNING_KEY"))
+		if err != nil {
+			slog.Critical(ctx, "Invalid OXCROSS_ORIGIN_SIGNING_KEY: %v, cannot initialize", err)
+			panic(err)
+		}
+		responseSigner = signer
+		slog.Info(ctx, "Origin server signing responses")
+	}
+
+	// Only serve probes from leaves with the keys given
+	if os.Getenv("OXCROSS_ORIGIN_LEAF_KEYS") != "" {
+		keys, err := parseLeafKeys(os.Getenv("OXCROSS_ORIGIN_LEAF_KEYS"))
+		if err != nil {
+			slog.Critical(ctx, "Invalid OXCROSS_ORIGIN_LEAF_KEYS: %v, cannot initialize", err)
+			panic(err)
+		}
+		leafKeys = keys
+		slog.Info(ctx, "Origin server only serving probes from %d leaf keys", len(keys))
+
+		// Probes are only checked against the clock of the origin on request
+		if envSkew := os.Getenv("OXCROSS_ORIGIN_LEAF_TIME_SKEW"); envSkew != "" {
+			skew, err := time.ParseDuration(envSkew)
+			if err != nil || skew <= 0 {
+				slog.Critical(ctx, "Invalid OXCROSS_ORIGIN_LEAF_TIME_SKEW: %s, cannot initialize", envSkew)
+				panic(err)
+			}
+			maxLeafTimeSkew = skew
+
+			// A replay is accepted until the time sent with a probe is skew past the origin
+			// clock, which is up to twice the skew after it was first received.
+			if 2*skew > nonceWindow {
+				recentNonces = newNonceSet(2*skew, maxRecentNonces)
+			}
+		}
+	}
+
+	// Throughput probes transfer as much as leaves ask for, so are only served on request,
+	// and only to leaves which sign their probes.
+	if os.Getenv("OXCROSS_ORIGIN_THROUGHPUT") == "true" {
+		if leafKeys == nil {
+			slog.Critical(ctx, "OXCROSS_ORIGIN_THROUGHPUT needs OXCROSS_ORIGIN_LEAF_KEYS to be set, cannot initialize")
+			panic("throughput probes need leaf keys")
+		}
+		serveThroughput = true
+
+		envMaxBytes := os.Getenv("OXCROSS_ORIGIN_THROUGHPUT_MAX_BYTES")
+		if envMaxBytes != "" {
+			maxBytes, err := strconv.ParseInt(envMaxBytes, 10, 64)
+			if err != nil || maxBytes < 1 || maxBytes > types.MaxThroughputBytes {
+				slog.Critical(ctx, "Invalid OXCROSS_ORIGIN_THROUGHPUT_MAX_BYTES: %s, cannot initialize", envMaxBytes)
+				panic(err)
+			}
+			throughputMaxBytes = maxBytes
+		}
+		slog.Info(ctx, "Origin server serving throughput probes of up to %d bytes", throughputMaxBytes)
+	}
+
 	// Initialise server for incoming requests
 	svc := service()
 	srv, err := typhon.Listen(svc, fmt.Sprintf(":%d", port))
@@ -69,6 +146,69 @@ func main() {
 
 	slog.Info(ctx, "Origin server listening on %v", srv.Listener().Addr())
 
+	// Serve HTTP/3 as well given a certificate, on the same port number over UDP by default
+	if os.Getenv("OXCROSS_ORIGIN_TLS_CERT") != "" || os.Getenv("OXCROSS_ORIGIN_TLS_KEY") != "" {
+		h3Port := port
+		envH3Port := os.Getenv("OXCROSS_ORIGIN_H3_PORT")
+		if envH3Port != "" {
+			portNum, err := strconv.ParseInt(envH3Port, 10, 64)
+			if err != nil || portNum < 1 || portNum > 32767 {
+				slog.Critical(ctx, "Invalid HTTP/3 port: %s, cannot initialize", envH3Port)
+				panic(err)
+			}
+			h3Port = int(portNum)
+		}
+
+		h3Srv, h3Conn, err := listenHTTP3(ctx, svc, h3Port, os.Getenv("OXCROSS_ORIGIN_TLS_CERT"), os.Getenv("OXCROSS_ORIGIN_TLS_KEY"))
+		if err != nil {
+			slog.Critical(ctx, "Error initializing HTTP/3 server: %v", err)
+			panic(err)
+		}
+		defer h3Conn.Close()
+		defer h3Srv.Close()
+
+		slog.Info(ctx, "Origin HTTP/3 server listening on %v", h3Conn.LocalAddr())
+	}
+
+	// Initialise UDP echo responder for UDP probes
+	echoPort := types.OriginEchoPort
+	envEchoPort := os.Getenv("OXCROSS_ORIGIN_ECHO_PORT")
+	if envEchoPort != "" {
+		portNum, err := strconv.ParseInt(envEchoPort, 10, 64)
+		if err != nil || portNum < 1 || portNum > 32767 {
+			slog.Critical(ctx, "Invalid echo port: %s, cannot initialize", envEchoPort)
+			panic(err)
+		}
+		echoPort = int(portNum)
+	}
+
+	// Limit replies to each source, which could be spoofed to direct replies elsewhere
+	echoRates := map[string]float64{
+		"OXCROSS_ORIGIN_ECHO_RATE":       defaultEchoSourceRate,
+		"OXCROSS_ORIGIN_ECHO_TOTAL_RATE": defaultEchoTotalRate,
+	}
+	for env := range echoRates {
+		if os.Getenv(env) == "" {
+			continue
+		}
+		rate, err := strconv.ParseFloat(os.Getenv(env), 64)
+		if err != nil || rate <= 0 {
+			slog.Critical(ctx, "Invalid %s: %s, cannot initialize", env, os.Getenv(env))
+			panic(err)
+		}
+		echoRates[env] = rate
+	}
+	limiter := newEchoLimiter(echoRates["OXCROSS_ORIGIN_ECHO_RATE"], echoRates["OXCROSS_ORIGIN_ECHO_TOTAL_RATE"])
+
+	echoConn, err := listenEcho(ctx, echoPort, limiter)
+	if err != nil {
+		slog.Critical(ctx, "Error initializing echo responder: %v", err)
+		panic(err)
+	}
+	defer echoConn.Close()
+
+	slog.Info(ctx, "Origin echo responder listening on %v", echoConn.LocalAddr())
+
 	// Log termination gracefully
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
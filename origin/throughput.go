@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/monzo/terrors"
+	"github.com/monzo/typhon"
+
+	"github.com/chongyangshi/oxcross/types"
+)
+
+// The throughput endpoints are only served if enabled, as each request to them can transfer
+// up to throughputMaxBytes.
+var (
+	serveThroughput    bool
+	throughputMaxBytes int64 = types.MaxThroughputBytes
+)
+
+// serveDownload streams the number of bytes requested for throughput probes. The bytes are
+// random, so that nothing along the way can compress them.
+func serveDownload(req typhon.Request) typhon.Response {
+	size, err := strconv.ParseInt(req.URL.Query().Get("bytes"), 10, 64)
+	if err != nil || size < 0 || size > throughputMaxBytes {
+		return typhon.Response{Error: terrors.BadRequest("invalid_bytes", "Number of bytes must be between 0 and "+strconv.FormatInt(throughputMaxBytes, 10), nil)}
+	}
+
+	payload := io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), size)
+	rsp := req.Response(ioutil.NopCloser(payload))
+	rsp.ContentLength = size
+	rsp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	rsp.Header.Set("Content-Type", "application/octet-stream")
+	rsp.Header.Set("Cache-Control", "no-store")
+
+	return rsp
+}
+
+// serveUpload discards what it is sent for throughput probes, reporting how much was
+// received and the time taken from the first byte to the last.
+func serveUpload(req typhon.Request) typhon.Response {
+	body := &timedReader{r: io.LimitReader(req.Body, throughputMaxBytes+1)}
+	size, err := io.Copy(ioutil.Discard, body)
+	if err != nil {
+		return typhon.Response{Error: terrors.Wrap(err, nil)}
+	}
+	if size > throughputMaxBytes {
+		return typhon.Response{Error: terrors.BadRequest("too_large", "Uploads must not exceed "+strconv.FormatInt(throughputMaxBytes, 10)+" bytes", nil)}
+	}
+
+	rsp := req.Response(&types.ThroughputUploadResponse{
+		Bytes:    size,
+		Duration: body.last.Sub(body.first).Seconds(),
+	})
+	rsp.Header.Set("Cache-Control", "no-store")
+
+	return rsp
+}
+
+// timedReader records when the first and last bytes were read from a reader.
+type timedReader struct {
+	r     io.Reader
+	first time.Time
+	last  time.Time
+}
+
+func (t *timedReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	if n > 0 {
+		now := time.Now()
+		if t.first.IsZero() {
+			t.first = now
+		}
+		t.last = now
+	}
+
+	return n, err
+}
@@ -7,7 +7,7 @@ fi;
 
 set -e
 
-GO_VERSION=1.14.2
+GO_VERSION=1.24.4
 LEAF_ID=$1
 API_BASE=$2
 
@@ -15,13 +15,12 @@ useradd oxcross || true
 sed -i "s#{{LEAFID}}#${LEAF_ID}#g" $(pwd)/leaf/oxcross-leaf.service
 sed -i "s#{{APIBASE}}#${API_BASE}#g" $(pwd)/leaf/oxcross-leaf.service
 
-[ -d "/usr/local/go" ] || [ -f "/tmp/go$GO_VERSION.linux-amd64.tar.gz" ] || wget https://dl.google.com/go/go$GO_VERSION.linux-amd64.tar.gz -O /tmp/go1.14.2.linux-amd64.tar.gz
+[ -d "/usr/local/go" ] || [ -f "/tmp/go$GO_VERSION.linux-amd64.tar.gz" ] || wget https://dl.google.com/go/go$GO_VERSION.linux-amd64.tar.gz -O /tmp/go$GO_VERSION.linux-amd64.tar.gz
 [ -d "/usr/local/go" ] || sudo tar -C /usr/local -zxf /tmp/go$GO_VERSION.linux-amd64.tar.gz
 export PATH=$PATH:/usr/local/go/bin
 rm -rf /tmp/go$GO_VERSION.linux-amd64.tar.gz
 
 cd leaf
-go get -d -v
 sudo make install
 systemctl enable oxcross-leaf
 systemctl restart oxcross-leaf
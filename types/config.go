@@ -4,8 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
 	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/monzo/slog"
 	"github.com/monzo/terrors"
@@ -22,9 +26,144 @@ const (
 	OriginModeAdvanced = "advanced"
 )
 
+// The type of an origin selects how it is probed. HTTP origins can be
+// probed in either simple or advanced mode, while TCP origins are only
+// checked for a successful connection and optionally an expected banner.
+// DNS origins query their hostname against each of their resolvers.
+// UDP origins send bursts of packets to the echo responder of an
+// Oxcross origin server, to measure packet loss and jitter, while ICMP
+// origins do the same with echo requests to any host. Traceroute origins
+// record the path taken to their hostname. Throughput origins download
+// from and upload to an Oxcross origin server, on a slower schedule.
+const (
+	OriginTypeHTTP = "http"
+	OriginTypeTCP  = "tcp"
+	OriginTypeDNS  = "dns"
+	OriginTypeUDP  = "udp"
+	OriginTypeICMP = "icmp"
+
+	OriginTypeTraceroute = "traceroute"
+	OriginTypeThroughput = "throughput"
+)
+
+// Directions which throughput origins can be probed in. Both downloads and
+// then uploads in each probe, so that the two do not compete for bandwidth.
+const (
+	ThroughputDirectionDownload = "download"
+	ThroughputDirectionUpload   = "upload"
+	ThroughputDirectionBoth     = "both"
+)
+
+// Protocols which traceroute origins can send their probes with
+const (
+	TracerouteProtocolUDP  = "udp"
+	TracerouteProtocolTCP  = "tcp"
+	TracerouteProtocolICMP = "icmp"
+)
+
+// Address families which origins can be probed over. By default either
+// family may be used, while both probes each family separately. Happy
+// eyeballs races connections over both families, as browsers do, and
+// reports which family won.
+const (
+	IPFamilyAny           = "any"
+	IPFamilyIPv4          = "ipv4"
+	IPFamilyIPv6          = "ipv6"
+	IPFamilyBoth          = "both"
+	IPFamilyHappyEyeballs = "happy_eyeballs"
+)
+
+var validIPFamilies = map[string]bool{
+	IPFamilyAny:           true,
+	IPFamilyIPv4:          true,
+	IPFamilyIPv6:          true,
+	IPFamilyBoth:          true,
+	IPFamilyHappyEyeballs: true,
+}
+
+// Connections which HTTP origins can be probed over. Cold probes make a new
+// connection each time, to time the full handshake, while warm probes reuse
+// a persistent connection as real clients do. Both probes each separately.
+const (
+	ConnectionModeCold = "cold"
+	ConnectionModeWarm = "warm"
+	ConnectionModeBoth = "both"
+)
+
+var validConnectionModes = map[string]bool{
+	ConnectionModeCold: true,
+	ConnectionModeWarm: true,
+	ConnectionModeBoth: true,
+}
+
+// HTTP protocols which HTTP origins can be probed with. HTTP/1.1 is used by
+// default, while auto negotiates HTTP/2 where the origin supports it over
+// TLS. HTTP/2 is only sent over TLS, while h2c is HTTP/2 without TLS, sent
+// with prior knowledge that the origin supports it. HTTP/3 is sent over QUIC,
+// which always uses TLS and cannot be sent through a proxy.
+const (
+	HTTPProtocolAuto  = "auto"
+	HTTPProtocolHTTP1 = "http1"
+	HTTPProtocolH2    = "h2"
+	HTTPProtocolH2C   = "h2c"
+	HTTPProtocolH3    = "h3"
+)
+
+var validHTTPProtocols = map[string]bool{
+	HTTPProtocolAuto:  true,
+	HTTPProtocolHTTP1: true,
+	HTTPProtocolH2:    true,
+	HTTPProtocolH2C:   true,
+	HTTPProtocolH3:    true,
+}
+
+// DNS record types which can be queried by DNS origins
+var validRecordTypes = map[string]bool{
+	"A":     true,
+	"AAAA":  true,
+	"CNAME": true,
+	"MX":    true,
+	"NS":    true,
+	"TXT":   true,
+}
+
+// Methods which can be used to probe an origin
+var validMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
 const (
 	defaultTimeout  = 10
 	defaultInterval = 10
+
+	defaultPacketCount    = 10
+	defaultPacketSize     = 64
+	defaultPacketInterval = 20
+	maxPacketCount        = EchoMaxBurst
+
+	// Similar to ping, but with a shorter interval to complete within a probe interval
+	defaultICMPPacketCount    = 5
+	defaultICMPPacketSize     = 56
+	defaultICMPPacketInterval = 200
+	minICMPPacketSize         = 16
+
+	// As in the traditional traceroute, UDP probes are sent to consecutive
+	// ports from 33434, which are unlikely to be listened on by the origin
+	defaultTracerouteUDPPort = 33434
+	defaultTracerouteTCPPort = 80
+	defaultMaxHops           = 30
+	maxMaxHops               = 64
+
+	// Transfers take long enough, and use enough bandwidth, to be run less often
+	defaultThroughputBytes    = 10 << 20
+	defaultThroughputTimeout  = 60
+	defaultThroughputInterval = 300
 )
 
 type Config struct {
@@ -34,11 +173,104 @@ type Config struct {
 }
 
 type OriginEntry struct {
+	// Identifies the origin in metrics, hostname-port-scheme by default. Origins which
+	// would otherwise share an ID, such as two paths on the same host, need their own.
+	ID string `json:"id"`
+
+	Type     string `json:"type"`
 	Scheme   string `json:"scheme"`
 	Hostname string `json:"hostname"`
 	Port     int    `json:"port"`
 	Mode     string `json:"mode"`
-	URL      string // To be composed from schme, hostname, and port
+	URL      string // To be composed from schme, hostname, port, and in simple mode path and query
+
+	// Timeout and interval in seconds for probing this origin, which default
+	// to those of the config.
+	Timeout  int `json:"timeout"`
+	Interval int `json:"interval"`
+
+	// The address family to probe the origin over, any by default.
+	IPFamily string `json:"ip_family"`
+
+	// Probe each address the hostname resolves to separately, rather than
+	// whichever address is connected to.
+	ProbeAllAddresses bool `json:"probe_all_addresses"`
+
+	// For HTTP origins, whether to probe over a new connection each time,
+	// a persistent connection, or both, cold by default.
+	ConnectionMode string `json:"connection_mode"`
+
+	// For HTTP and TCP origins, an optional proxy to connect through, as an
+	// http:// URL for HTTP CONNECT proxies or a socks5:// URL, with optional
+	// credentials. This overrides any proxy set for the leaf.
+	Proxy string `json:"proxy"`
+
+	// For HTTP origins in advanced mode, an optional public ed25519 key, as
+	// ed25519:<base64 key>, which responses must be signed with. This
+	// overrides any key set for the leaf.
+	OriginKey string `json:"origin_key"`
+
+	// Optional request customisations, path and query are only used in simple mode
+	Path       string            `json:"path"`
+	Query      string            `json:"query"`
+	Method     string            `json:"method"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	HostHeader string            `json:"host_header"`
+
+	Assertions OriginAssertions `json:"assertions"`
+
+	// For TCP origins, optionally send a payload once connected, and expect
+	// a string to be present in what the origin sends back, such as the
+	// banner of an SSH or SMTP server.
+	Send   string `json:"send"`
+	Expect string `json:"expect"`
+
+	// For DNS origins, resolvers are given as udp://host:port, tcp://host:port
+	// or the https:// URL of a DNS-over-HTTPS endpoint. If expected answers are
+	// given, the answers from each resolver must match them in any order.
+	Resolvers       []string `json:"resolvers"`
+	RecordType      string   `json:"record_type"`
+	ExpectedAnswers []string `json:"expected_answers"`
+
+	// For UDP and ICMP origins, the number and size in bytes of packets sent
+	// in each burst, and the interval in milliseconds between them. ICMP echo
+	// requests can also be sent with the don't fragment bit set.
+	Count            int  `json:"count"`
+	PacketSize       int  `json:"packet_size"`
+	PacketIntervalMs int  `json:"packet_interval_ms"`
+	DontFragment     bool `json:"dont_fragment"`
+
+	// For traceroute origins, the protocol of probes sent and the highest TTL
+	// probed. TCP probes are sent to the port of the origin. For HTTP origins,
+	// the HTTP protocol to probe with.
+	Protocol string `json:"protocol"`
+	MaxHops  int    `json:"max_hops"`
+
+	// For throughput origins, whether to download, upload or both, and the
+	// number of bytes transferred each way.
+	Direction     string `json:"direction"`
+	DownloadBytes int64  `json:"download_bytes"`
+	UploadBytes   int64  `json:"upload_bytes"`
+}
+
+// OriginAssertions are checked against each response from an origin, with any failing
+// assertion failing the probe. By default we accept any status code below 400.
+type OriginAssertions struct {
+	StatusCodes     []int  `json:"status_codes"`
+	BodyContains    string `json:"body_contains"`
+	BodyNotContains string `json:"body_not_contains"`
+	BodyRegex       string `json:"body_regex"`
+	BodyNotRegex    string `json:"body_not_regex"`
+	MaxBodyBytes    int64  `json:"max_body_bytes"`
+
+	// Expected values of fields in a JSON response body, keyed by dot-separated paths
+	// such as "checks.database.0.healthy".
+	JSONFields map[string]interface{} `json:"json_fields"`
+
+	// Compiled from BodyRegex and BodyNotRegex
+	BodyPattern    *regexp.Regexp `json:"-"`
+	BodyNotPattern *regexp.Regexp `json:"-"`
 }
 
 func ParseConfig(ctx context.Context, configBody []byte) (*Config, error) {
@@ -49,10 +281,10 @@ func ParseConfig(ctx context.Context, configBody []byte) (*Config, error) {
 		return nil, err
 	}
 
-	switch {
-	case cfg.Timeout == 0:
+	if cfg.Timeout == 0 {
 		cfg.Timeout = defaultTimeout
-	case cfg.Interval == 0:
+	}
+	if cfg.Interval == 0 {
 		cfg.Interval = defaultInterval
 	}
 	slog.Info(ctx, "Oxcross loaded %d origins, with timeout %ds, and interval %ds", len(cfg.Origins), cfg.Timeout, cfg.Interval)
@@ -64,40 +296,86 @@ func ParseConfig(ctx context.Context, configBody []byte) (*Config, error) {
 
 	origins := []OriginEntry{}
 	for _, origin := range cfg.Origins {
-		if origin.Scheme != "http" && origin.Scheme != "https" {
-			slog.Warn(ctx, "Oxcross found invalid scheme %s for hostname %s and port %d, skipping", origin.Scheme, origin.Hostname, origin.Port, errParams)
+		if origin.Port < 0 || origin.Port > 65535 {
+			slog.Warn(ctx, "Oxcross found invalid port %d for hostname %s and scheme %s, skipping", origin.Port, origin.Hostname, origin.Scheme, errParams)
 			continue
 		}
 
-		if origin.Port < 0 || origin.Port > 32767 {
-			slog.Warn(ctx, "Oxcross found invalid port %d for hostname %s and scheme %s, skipping", origin.Port, origin.Hostname, origin.Scheme, errParams)
+		if origin.Timeout == 0 {
+			origin.Timeout = cfg.Timeout
+			if origin.Type == OriginTypeThroughput {
+				origin.Timeout = defaultThroughputTimeout
+			}
+		}
+		if origin.Interval == 0 {
+			origin.Interval = cfg.Interval
+			if origin.Type == OriginTypeThroughput {
+				origin.Interval = defaultThroughputInterval
+			}
+		}
+		if origin.Timeout <= 0 || origin.Interval <= 0 {
+			slog.Warn(ctx, "Oxcross found invalid timeout %d or interval %d for hostname %s, skipping", origin.Timeout, origin.Interval, origin.Hostname, errParams)
 			continue
 		}
 
-		// Default to advanced mode if not set
-		mode := origin.Mode
-		if origin.Mode == "" {
-			mode = OriginModeAdvanced
+		if origin.IPFamily == "" {
+			origin.IPFamily = IPFamilyAny
+		}
+		if !validIPFamilies[origin.IPFamily] {
+			slog.Warn(ctx, "Oxcross found invalid IP family %s for hostname %s, skipping", origin.IPFamily, origin.Hostname, errParams)
+			continue
 		}
 
-		// In advanced mode, we retrieve synchronization information from the fixed endpoint
-		fullURL := fmt.Sprintf("%s://%s:%d", origin.Scheme, origin.Hostname, origin.Port)
-		if mode == OriginModeAdvanced {
-			fullURL = fmt.Sprintf("%s/oxcross", fullURL)
+		// Default to HTTP if not set
+		if origin.Type == "" {
+			origin.Type = OriginTypeHTTP
 		}
 
-		if _, err := url.Parse(fullURL); err != nil {
-			slog.Warn(ctx, "Invalid URL parsed: %s, skipping", fullURL)
-			continue
+		if origin.Proxy != "" {
+			if origin.Type != OriginTypeHTTP && origin.Type != OriginTypeTCP && origin.Type != OriginTypeThroughput {
+				slog.Warn(ctx, "Oxcross cannot probe %s hostname %s through a proxy, skipping", origin.Type, origin.Hostname, errParams)
+				continue
+			}
+
+			proxyURL, err := ParseProxy(origin.Proxy)
+			if err != nil {
+				slog.Warn(ctx, "Oxcross found invalid proxy for hostname %s: %v, skipping", origin.Hostname, err, errParams)
+				continue
+			}
+			origin.Proxy = proxyURL.String()
+		}
+
+		var o OriginEntry
+		var valid bool
+		switch origin.Type {
+		case OriginTypeHTTP:
+			o, valid = parseHTTPOrigin(ctx, origin, errParams)
+		case OriginTypeTCP:
+			o, valid = parseTCPOrigin(ctx, origin, errParams)
+		case OriginTypeDNS:
+			o, valid = parseDNSOrigin(ctx, origin, errParams)
+		case OriginTypeUDP:
+			o, valid = parseUDPOrigin(ctx, origin, errParams)
+		case OriginTypeICMP:
+			o, valid = parseICMPOrigin(ctx, origin, errParams)
+		case OriginTypeTraceroute:
+			o, valid = parseTracerouteOrigin(ctx, origin, errParams)
+		case OriginTypeThroughput:
+			o, valid = parseThroughputOrigin(ctx, origin, errParams)
+		default:
+			slog.Warn(ctx, "Oxcross found invalid type %s for hostname %s and port %d, skipping", origin.Type, origin.Hostname, origin.Port, errParams)
 		}
 
-		o := origin
-		o.URL = fullURL
-		o.Mode = mode
+		if valid {
+			origins = append(origins, o)
+		}
+	}
 
-		origins = append(origins, o)
+	cfg.Origins, err = uniqueOrigins(ctx, origins)
+	if err != nil {
+		slog.Error(ctx, "Oxcross error parsing config: %v", err)
+		return nil, err
 	}
-	cfg.Origins = origins
 
 	slog.Info(ctx, "Oxcross loaded %d valid origins", len(cfg.Origins))
 
@@ -109,3 +387,433 @@ func ParseConfig(ctx context.Context, configBody []byte) (*Config, error) {
 
 	return &cfg, nil
 }
+
+// OriginID identifies the origin in metrics.
+func (o OriginEntry) OriginID() string {
+	if o.ID != "" {
+		return o.ID
+	}
+
+	return fmt.Sprintf("%s-%d-%s", o.Hostname, o.Port, o.Scheme)
+}
+
+// uniqueOrigins skips origins configured more than once. Different origins sharing an ID
+// would overwrite each other's metrics, so are rejected instead.
+func uniqueOrigins(ctx context.Context, origins []OriginEntry) ([]OriginEntry, error) {
+	unique := []OriginEntry{}
+	seen := map[string]string{}
+	for _, origin := range origins {
+		config, err := json.Marshal(origin)
+		if err != nil {
+			return nil, terrors.Wrap(err, nil)
+		}
+
+		previous, found := seen[origin.OriginID()]
+		switch {
+		case !found:
+			seen[origin.OriginID()] = string(config)
+			unique = append(unique, origin)
+		case previous == string(config):
+			slog.Warn(ctx, "Oxcross found duplicate origin %s, skipping", origin.OriginID())
+		default:
+			return nil, terrors.BadRequest("duplicate_origin_id", fmt.Sprintf("Different origins share the ID %s, and need an id of their own: %s and %s", origin.OriginID(), previous, config), nil)
+		}
+	}
+
+	return unique, nil
+}
+
+func compileAssertions(assertions OriginAssertions) (OriginAssertions, error) {
+	for _, code := range assertions.StatusCodes {
+		if code < 100 || code > 599 {
+			return assertions, terrors.BadRequest("invalid_status_code", fmt.Sprintf("Invalid status code %d", code), nil)
+		}
+	}
+
+	if assertions.MaxBodyBytes < 0 {
+		return assertions, terrors.BadRequest("invalid_max_body_bytes", fmt.Sprintf("Invalid maximum body size %d", assertions.MaxBodyBytes), nil)
+	}
+
+	if assertions.BodyRegex != "" {
+		pattern, err := regexp.Compile(assertions.BodyRegex)
+		if err != nil {
+			return assertions, terrors.Wrap(err, nil)
+		}
+		assertions.BodyPattern = pattern
+	}
+
+	if assertions.BodyNotRegex != "" {
+		pattern, err := regexp.Compile(assertions.BodyNotRegex)
+		if err != nil {
+			return assertions, terrors.Wrap(err, nil)
+		}
+		assertions.BodyNotPattern = pattern
+	}
+
+	return assertions, nil
+}
+
+func parseHTTPOrigin(ctx context.Context, origin OriginEntry, errParams map[string]string) (OriginEntry, bool) {
+	if origin.Scheme != "http" && origin.Scheme != "https" {
+		slog.Warn(ctx, "Oxcross found invalid scheme %s for hostname %s and port %d, skipping", origin.Scheme, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	}
+
+	// Default to advanced mode if not set
+	mode := origin.Mode
+	if origin.Mode == "" {
+		mode = OriginModeAdvanced
+	}
+
+	method := strings.ToUpper(origin.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !validMethods[method] {
+		slog.Warn(ctx, "Oxcross found invalid method %s for hostname %s and port %d, skipping", origin.Method, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	}
+
+	// In advanced mode, we retrieve synchronization information from the fixed endpoint
+	fullURL := fmt.Sprintf("%s://%s:%d", origin.Scheme, origin.Hostname, origin.Port)
+	if mode == OriginModeAdvanced {
+		fullURL = fmt.Sprintf("%s/oxcross", fullURL)
+	} else {
+		path := origin.Path
+		if path != "" && !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		fullURL = fmt.Sprintf("%s%s", fullURL, path)
+
+		if origin.Query != "" {
+			if _, err := url.ParseQuery(origin.Query); err != nil {
+				slog.Warn(ctx, "Oxcross found invalid query %s for hostname %s and port %d, skipping", origin.Query, origin.Hostname, origin.Port, errParams)
+				return origin, false
+			}
+			fullURL = fmt.Sprintf("%s?%s", fullURL, origin.Query)
+		}
+	}
+
+	if _, err := url.Parse(fullURL); err != nil {
+		slog.Warn(ctx, "Invalid URL parsed: %s, skipping", fullURL)
+		return origin, false
+	}
+
+	assertions, err := compileAssertions(origin.Assertions)
+	if err != nil {
+		slog.Warn(ctx, "Oxcross found invalid assertions for hostname %s and port %d: %v, skipping", origin.Hostname, origin.Port, err, errParams)
+		return origin, false
+	}
+
+	connectionMode := origin.ConnectionMode
+	if connectionMode == "" {
+		connectionMode = ConnectionModeCold
+	}
+	if !validConnectionModes[connectionMode] {
+		slog.Warn(ctx, "Oxcross found invalid connection mode %s for hostname %s and port %d, skipping", origin.ConnectionMode, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	}
+
+	protocol := origin.Protocol
+	if protocol == "" {
+		protocol = HTTPProtocolHTTP1
+	}
+	switch {
+	case !validHTTPProtocols[protocol]:
+		slog.Warn(ctx, "Oxcross found invalid protocol %s for hostname %s and port %d, skipping", protocol, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	case (protocol == HTTPProtocolH2 || protocol == HTTPProtocolH3) && origin.Scheme != "https":
+		slog.Warn(ctx, "Oxcross found protocol %s for hostname %s and port %d, which needs https, skipping", protocol, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	case protocol == HTTPProtocolH2C && origin.Scheme != "http":
+		slog.Warn(ctx, "Oxcross found protocol %s for hostname %s and port %d, which needs http, skipping", protocol, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	case protocol == HTTPProtocolH3 && origin.Proxy != "":
+		slog.Warn(ctx, "Oxcross cannot send protocol %s for hostname %s and port %d through a proxy, skipping", protocol, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	}
+
+	// The config is served to every leaf, so HMAC secrets do not belong in it
+	if origin.OriginKey != "" {
+		if mode != OriginModeAdvanced {
+			slog.Warn(ctx, "Oxcross found origin key for hostname %s and port %d, which needs advanced mode, skipping", origin.Hostname, origin.Port, errParams)
+			return origin, false
+		}
+		if !strings.HasPrefix(origin.OriginKey, KeyTypeEd25519+":") {
+			slog.Warn(ctx, "Oxcross found origin key for hostname %s and port %d which is not an ed25519 public key, skipping", origin.Hostname, origin.Port, errParams)
+			return origin, false
+		}
+		if _, err := ParseVerifyKey(origin.OriginKey); err != nil {
+			slog.Warn(ctx, "Oxcross found invalid origin key for hostname %s and port %d: %v, skipping", origin.Hostname, origin.Port, err, errParams)
+			return origin, false
+		}
+	}
+
+	o := origin
+	o.Assertions = assertions
+	o.ConnectionMode = connectionMode
+	o.Protocol = protocol
+	o.URL = fullURL
+	o.Mode = mode
+	o.Method = method
+
+	return o, true
+}
+
+func parseTCPOrigin(ctx context.Context, origin OriginEntry, errParams map[string]string) (OriginEntry, bool) {
+	if origin.Scheme != "" && origin.Scheme != OriginTypeTCP {
+		slog.Warn(ctx, "Oxcross found invalid scheme %s for TCP hostname %s and port %d, skipping", origin.Scheme, origin.Hostname, origin.Port, errParams)
+		return origin, false
+	}
+
+	o := origin
+	o.Scheme = OriginTypeTCP
+	o.URL = fmt.Sprintf("tcp://%s", net.JoinHostPort(origin.Hostname, strconv.Itoa(origin.Port)))
+
+	return o, true
+}
+
+func parseDNSOrigin(ctx context.Context, origin OriginEntry, errParams map[string]string) (OriginEntry, bool) {
+	recordType := strings.ToUpper(origin.RecordType)
+	if recordType == "" {
+		recordType = "A"
+	}
+	if !validRecordTypes[recordType] {
+		slog.Warn(ctx, "Oxcross found invalid record type %s for DNS hostname %s, skipping", origin.RecordType, origin.Hostname, errParams)
+		return origin, false
+	}
+
+	if len(origin.Resolvers) == 0 {
+		slog.Warn(ctx, "Oxcross found no resolvers for DNS hostname %s, skipping", origin.Hostname, errParams)
+		return origin, false
+	}
+
+	// The hostname of a DNS origin is only queried, and never connected to
+	if origin.ProbeAllAddresses {
+		slog.Warn(ctx, "Oxcross cannot probe all addresses of DNS hostname %s, skipping", origin.Hostname, errParams)
+		return origin, false
+	}
+
+	resolvers := []string{}
+	for _, resolver := range origin.Resolvers {
+		r, err := normaliseResolver(resolver)
+		if err != nil {
+			slog.Warn(ctx, "Oxcross found invalid resolver %s for DNS hostname %s: %v, skipping", resolver, origin.Hostname, err, errParams)
+			return origin, false
+		}
+		resolvers = append(resolvers, r)
+	}
+
+	o := origin
+	o.Scheme = OriginTypeDNS
+	o.RecordType = recordType
+	o.Resolvers = resolvers
+	o.URL = fmt.Sprintf("dns://%s/%s", origin.Hostname, recordType)
+
+	return o, true
+}
+
+// Proxy schemes supported, and the ports they are assumed to listen on if not given
+var proxyPorts = map[string]string{
+	"http":   "8080",
+	"socks5": "1080",
+}
+
+// ParseProxy parses the URL of an HTTP CONNECT or SOCKS5 proxy, which may carry credentials.
+func ParseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, terrors.Wrap(err, nil)
+	}
+
+	port, found := proxyPorts[u.Scheme]
+	if !found {
+		return nil, terrors.BadRequest("invalid_proxy", fmt.Sprintf("Unsupported proxy scheme %s", u.Scheme), nil)
+	}
+	if u.Hostname() == "" {
+		return nil, terrors.BadRequest("invalid_proxy", fmt.Sprintf("No host in %s proxy", u.Scheme), nil)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	return &url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host}, nil
+}
+
+// normaliseResolver turns a resolver address into a URL with an explicit scheme and port,
+// with plain addresses defaulting to UDP.
+func normaliseResolver(resolver string) (string, error) {
+	if !strings.Contains(resolver, "://") {
+		resolver = fmt.Sprintf("udp://%s", resolver)
+	}
+
+	u, err := url.Parse(resolver)
+	if err != nil {
+		return "", terrors.Wrap(err, nil)
+	}
+
+	switch u.Scheme {
+	case "https":
+		return u.String(), nil
+	case "udp", "tcp":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "53")
+		}
+		if u.Hostname() == "" {
+			return "", terrors.BadRequest("invalid_resolver", fmt.Sprintf("No host in resolver %s", resolver), nil)
+		}
+		return fmt.Sprintf("%s://%s", u.Scheme, u.Host), nil
+	default:
+		return "", terrors.BadRequest("invalid_resolver", fmt.Sprintf("Unsupported resolver scheme %s", u.Scheme), nil)
+	}
+}
+
+func parseUDPOrigin(ctx context.Context, origin OriginEntry, errParams map[string]string) (OriginEntry, bool) {
+	o := origin
+	o.Scheme = OriginTypeUDP
+	if o.Port == 0 {
+		o.Port = OriginEchoPort
+	}
+	if o.Count == 0 {
+		o.Count = defaultPacketCount
+	}
+	if o.PacketSize == 0 {
+		o.PacketSize = defaultPacketSize
+	}
+	if o.PacketIntervalMs == 0 {
+		o.PacketIntervalMs = defaultPacketInterval
+	}
+
+	switch {
+	case o.Count < 0 || o.Count > maxPacketCount:
+		slog.Warn(ctx, "Oxcross found invalid packet count %d for UDP hostname %s, skipping", o.Count, o.Hostname, errParams)
+		return origin, false
+	case o.PacketSize < EchoHeaderSize || o.PacketSize > EchoMaxPacketSize:
+		slog.Warn(ctx, "Oxcross found invalid packet size %d for UDP hostname %s, skipping", o.PacketSize, o.Hostname, errParams)
+		return origin, false
+	case o.PacketIntervalMs < 0:
+		slog.Warn(ctx, "Oxcross found invalid packet interval %d for UDP hostname %s, skipping", o.PacketIntervalMs, o.Hostname, errParams)
+		return origin, false
+	}
+
+	o.URL = fmt.Sprintf("udp://%s", net.JoinHostPort(o.Hostname, strconv.Itoa(o.Port)))
+
+	return o, true
+}
+
+func parseICMPOrigin(ctx context.Context, origin OriginEntry, errParams map[string]string) (OriginEntry, bool) {
+	o := origin
+	o.Scheme = OriginTypeICMP
+	o.Port = 0
+	if o.Count == 0 {
+		o.Count = defaultICMPPacketCount
+	}
+	if o.PacketSize == 0 {
+		o.PacketSize = defaultICMPPacketSize
+	}
+	if o.PacketIntervalMs == 0 {
+		o.PacketIntervalMs = defaultICMPPacketInterval
+	}
+
+	switch {
+	case o.Count < 0 || o.Count > maxPacketCount:
+		slog.Warn(ctx, "Oxcross found invalid packet count %d for ICMP hostname %s, skipping", o.Count, o.Hostname, errParams)
+		return origin, false
+	case o.PacketSize < minICMPPacketSize || o.PacketSize > EchoMaxPacketSize:
+		slog.Warn(ctx, "Oxcross found invalid packet size %d for ICMP hostname %s, skipping", o.PacketSize, o.Hostname, errParams)
+		return origin, false
+	case o.PacketIntervalMs < 0:
+		slog.Warn(ctx, "Oxcross found invalid packet interval %d for ICMP hostname %s, skipping", o.PacketIntervalMs, o.Hostname, errParams)
+		return origin, false
+	}
+
+	o.URL = fmt.Sprintf("icmp://%s", o.Hostname)
+
+	return o, true
+}
+
+func parseTracerouteOrigin(ctx context.Context, origin OriginEntry, errParams map[string]string) (OriginEntry, bool) {
+	o := origin
+	o.Scheme = OriginTypeTraceroute
+	if o.Protocol == "" {
+		o.Protocol = TracerouteProtocolUDP
+	}
+	if o.MaxHops == 0 {
+		o.MaxHops = defaultMaxHops
+	}
+
+	switch o.Protocol {
+	case TracerouteProtocolUDP:
+		if o.Port == 0 {
+			o.Port = defaultTracerouteUDPPort
+		}
+	case TracerouteProtocolTCP:
+		if o.Port == 0 {
+			o.Port = defaultTracerouteTCPPort
+		}
+	case TracerouteProtocolICMP:
+		o.Port = 0
+	default:
+		slog.Warn(ctx, "Oxcross found invalid protocol %s for traceroute hostname %s, skipping", o.Protocol, o.Hostname, errParams)
+		return origin, false
+	}
+
+	switch {
+	case o.MaxHops < 1 || o.MaxHops > maxMaxHops:
+		slog.Warn(ctx, "Oxcross found invalid max hops %d for traceroute hostname %s, skipping", o.MaxHops, o.Hostname, errParams)
+		return origin, false
+	case o.Protocol == TracerouteProtocolUDP && o.Port+o.MaxHops-1 > 65535:
+		// UDP probes are sent to one port per hop
+		slog.Warn(ctx, "Oxcross found invalid port %d for %d hops to traceroute hostname %s, skipping", o.Port, o.MaxHops, o.Hostname, errParams)
+		return origin, false
+	}
+
+	o.URL = fmt.Sprintf("traceroute+%s://%s", o.Protocol, o.Hostname)
+	if o.Port != 0 {
+		o.URL = fmt.Sprintf("traceroute+%s://%s", o.Protocol, net.JoinHostPort(o.Hostname, strconv.Itoa(o.Port)))
+	}
+
+	return o, true
+}
+
+func parseThroughputOrigin(ctx context.Context, origin OriginEntry, errParams map[string]string) (OriginEntry, bool) {
+	// Transfers are made over HTTP or HTTPS, while the scheme of the origin tells its probes
+	// apart from those of an HTTP origin on the same port.
+	o := origin
+	scheme := strings.TrimPrefix(o.Scheme, OriginTypeThroughput+"+")
+	if scheme == "" {
+		scheme = "http"
+	}
+	if o.Port == 0 {
+		o.Port = OriginServerPort
+	}
+	if o.Direction == "" {
+		o.Direction = ThroughputDirectionBoth
+	}
+	if o.DownloadBytes == 0 {
+		o.DownloadBytes = defaultThroughputBytes
+	}
+	if o.UploadBytes == 0 {
+		o.UploadBytes = defaultThroughputBytes
+	}
+
+	switch {
+	case scheme != "http" && scheme != "https":
+		slog.Warn(ctx, "Oxcross found invalid scheme %s for throughput hostname %s, skipping", o.Scheme, o.Hostname, errParams)
+		return origin, false
+	case o.Direction != ThroughputDirectionDownload && o.Direction != ThroughputDirectionUpload && o.Direction != ThroughputDirectionBoth:
+		slog.Warn(ctx, "Oxcross found invalid direction %s for throughput hostname %s, skipping", o.Direction, o.Hostname, errParams)
+		return origin, false
+	case o.DownloadBytes < 0 || o.DownloadBytes > MaxThroughputBytes:
+		slog.Warn(ctx, "Oxcross found invalid download size %d for throughput hostname %s, skipping", o.DownloadBytes, o.Hostname, errParams)
+		return origin, false
+	case o.UploadBytes < 0 || o.UploadBytes > MaxThroughputBytes:
+		slog.Warn(ctx, "Oxcross found invalid upload size %d for throughput hostname %s, skipping", o.UploadBytes, o.Hostname, errParams)
+		return origin, false
+	}
+
+	o.Scheme = fmt.Sprintf("%s+%s", OriginTypeThroughput, scheme)
+	o.URL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(o.Hostname, strconv.Itoa(o.Port)))
+
+	return o, true
+}
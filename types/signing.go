@@ -0,0 +1,160 @@
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/monzo/terrors"
+)
+
+// Leaves identify themselves to advanced origins in LeafIDHeader, and may sign the headers
+// of their requests in LeafSignatureHeader, so that origins can reject unknown leaves.
+const (
+	LeafIDHeader        = "X-Oxcross-Leaf-ID"
+	LeafSignatureHeader = "X-Oxcross-Leaf-Signature"
+)
+
+// StaleProbeCode is the code of the error origins reject signed probes with when they were
+// sent too far from the time of the origin, so that leaves can tell their clock is off.
+const StaleProbeCode = "stale_probe"
+
+// Keys are given as an HMAC secret shared by both sides, as "hmac:<secret>", or as an
+// ed25519 key pair, as "ed25519:<base64 key>". A private ed25519 key signs, and may be given
+// as its 32 byte seed or in full, while the public key of the pair verifies.
+const (
+	KeyTypeHMAC    = "hmac"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// Signer signs messages, returning the signature in base64.
+type Signer interface {
+	Sign(message []byte) string
+}
+
+// Verifier verifies a signature in base64 made by the corresponding Signer.
+type Verifier interface {
+	Verify(message []byte, signature string) bool
+}
+
+type hmacKey []byte
+
+func (k hmacKey) Sign(message []byte) string {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(message)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (k hmacKey) Verify(message []byte, signature string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, k)
+	mac.Write(message)
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
+
+type ed25519Signer ed25519.PrivateKey
+
+func (k ed25519Signer) Sign(message []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(k), message))
+}
+
+type ed25519Verifier ed25519.PublicKey
+
+func (k ed25519Verifier) Verify(message []byte, signature string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(ed25519.PublicKey(k), message, decoded)
+}
+
+func splitKey(key string) (string, string, error) {
+	parts := strings.SplitN(key, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", terrors.BadRequest("invalid_key", "Keys must be given as hmac:<secret> or ed25519:<base64 key>", nil)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// ParseSigningKey parses a key to sign with, which is an HMAC secret or a private ed25519 key.
+func ParseSigningKey(key string) (Signer, error) {
+	keyType, value, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyType {
+	case KeyTypeHMAC:
+		return hmacKey(value), nil
+	case KeyTypeEd25519:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, terrors.Wrap(err, nil)
+		}
+		switch len(decoded) {
+		case ed25519.SeedSize:
+			return ed25519Signer(ed25519.NewKeyFromSeed(decoded)), nil
+		case ed25519.PrivateKeySize:
+			return ed25519Signer(decoded), nil
+		default:
+			return nil, terrors.BadRequest("invalid_key", fmt.Sprintf("Private ed25519 keys are %d or %d bytes, not %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(decoded)), nil)
+		}
+	default:
+		return nil, terrors.BadRequest("invalid_key", fmt.Sprintf("Unsupported key type %s", keyType), nil)
+	}
+}
+
+// ParseVerifyKey parses a key to verify signatures with, which is an HMAC secret or a public
+// ed25519 key.
+func ParseVerifyKey(key string) (Verifier, error) {
+	keyType, value, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch keyType {
+	case KeyTypeHMAC:
+		return hmacKey(value), nil
+	case KeyTypeEd25519:
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, terrors.Wrap(err, nil)
+		}
+		if len(decoded) != ed25519.PublicKeySize {
+			return nil, terrors.BadRequest("invalid_key", fmt.Sprintf("Public ed25519 keys are %d bytes, not %d", ed25519.PublicKeySize, len(decoded)), nil)
+		}
+		return ed25519Verifier(decoded), nil
+	default:
+		return nil, terrors.BadRequest("invalid_key", fmt.Sprintf("Unsupported key type %s", keyType), nil)
+	}
+}
+
+// SigningMessage is what an origin signs in its response. It covers the nonce and the time
+// sent by the leaf, so that a signed response cannot be replayed to another request, and is
+// kept apart from the requests of leaves in case both sides share an HMAC secret.
+func (r OriginResponse) SigningMessage() []byte {
+	return []byte(strings.Join([]string{
+		"oxcross-response",
+		r.ServerTime,
+		r.Token,
+		r.Nonce,
+		strconv.FormatInt(r.LeafTime, 10),
+		strconv.FormatInt(r.ReceiveTime, 10),
+		strconv.FormatInt(r.TransmitTime, 10),
+	}, "\n"))
+}
+
+// ProbeSigningMessage is what a leaf signs in its request, from the values of its headers.
+func ProbeSigningMessage(leafID, nonce, leafTime string) []byte {
+	return []byte(strings.Join([]string{"oxcross-request", leafID, nonce, leafTime}, "\n"))
+}
@@ -4,9 +4,53 @@ const (
 	ProbeMetricsServerPort = 9299
 	ConfigServerPort       = 9300
 	OriginServerPort       = 9301
+	OriginEchoPort         = 9302
 )
 
+// Datagrams sent to the UDP echo responder of an origin must begin with EchoMagic,
+// followed by the sequence number and other fields of the probe; anything else is
+// dropped rather than echoed. As replies are as large as the datagrams they answer, and
+// UDP sources can be spoofed, the responder also limits how fast it replies to each
+// source, while still answering the largest burst a leaf sends in full.
+const (
+	EchoMagic         = "OXCE"
+	EchoHeaderSize    = 24
+	EchoMaxPacketSize = 1472
+	EchoMaxBurst      = 1000
+)
+
+// Endpoints of an origin server for throughput probes. The download endpoint streams as
+// many bytes as requested in its bytes query parameter, while the upload endpoint discards
+// whatever it is sent, up to MaxThroughputBytes either way unless the origin is configured
+// with a lower limit.
+const (
+	ThroughputDownloadPath = "/oxcross/download"
+	ThroughputUploadPath   = "/oxcross/upload"
+	MaxThroughputBytes     = 100 << 20
+)
+
+// Advanced origins echo the value of NonceHeader in their responses, so that leaves can
+// tell a response to their request apart from one cached from an earlier request.
+const NonceHeader = "X-Oxcross-Nonce"
+
+// ThroughputUploadResponse is what an origin received on its upload endpoint, and the time
+// between it reading the first and the last byte.
+type ThroughputUploadResponse struct {
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_seconds"`
+}
+
+// Leaves send the time they sent a request to an advanced origin in LeafTimeHeader, as
+// nanoseconds since the Unix epoch, for the origin to echo along with the times it received
+// the request and sent its response.
+const LeafTimeHeader = "X-Oxcross-Leaf-Time"
+
 type OriginResponse struct {
-	ServerTime string `json:"server_time"`
-	Token      string `json:"token"`
+	ServerTime   string `json:"server_time"`
+	Token        string `json:"token"`
+	Nonce        string `json:"nonce,omitempty"`         // Echoed from the request header, if sent
+	LeafTime     int64  `json:"leaf_time,omitempty"`     // Echoed from the request header, if sent
+	ReceiveTime  int64  `json:"receive_time,omitempty"`  // In nanoseconds since the Unix epoch
+	TransmitTime int64  `json:"transmit_time,omitempty"` // In nanoseconds since the Unix epoch
+	Signature    string `json:"signature,omitempty"`     // Of SigningMessage, by origins with a key
 }